@@ -0,0 +1,106 @@
+// Copyright 2014, Hǎiliàng Wáng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cwrap
+
+import "sort"
+
+// anonType is an anonymous struct or union declared by a field, named after
+// its parent and the field, e.g. Parent_Field.
+type anonType struct {
+	decl   TypeDecl
+	parent TypeDecl // declares the Go name of the parent
+	field  string   // Go name of the field
+}
+
+// anonymousTypes returns the anonymous structs and unions of fields by their
+// ids.
+func (pac *Package) anonymousTypes() map[string]*anonType {
+	anon := make(map[string]*anonType)
+	add := func(parent TypeDecl, field string, i int, t EqualType) {
+		d := anonymousOf(t)
+		if d == nil {
+			return
+		}
+		if field == "" {
+			field = sprint("Anon", i)
+		}
+		// prefer the name of a typedef to the name of its struct
+		if a, ok := anon[d.Id()]; ok {
+			if _, ok := a.parent.(*Typedef); ok {
+				return
+			}
+		}
+		anon[d.Id()] = &anonType{d, parent, field}
+	}
+	pac.TypeDeclMap.Each(func(d TypeDecl) {
+		if _, ok := d.(*Typedef); !ok && pac.TypeDeclMap[d.Id()] != d {
+			// the literal of a typedef, visited with the typedef
+			return
+		}
+		if s := structOf(d); s != nil {
+			for i, f := range s.Fields {
+				add(d, f.goName, i, f.EqualType)
+			}
+		} else if u := unionOf(d); u != nil {
+			for i, f := range u.Fields {
+				add(d, f.goName, i, f.EqualType)
+			}
+		}
+	})
+	return anon
+}
+
+// anonymousOf returns the anonymous struct or union of a field type, including
+// the element type of an array.
+func anonymousOf(t EqualType) TypeDecl {
+	switch r := t.(type) {
+	case *Struct:
+		if r.CName() == "" {
+			return r
+		}
+	case *Union:
+		if r.CName() == "" {
+			return r
+		}
+	case *Array:
+		return anonymousOf(r.elementType)
+	}
+	return nil
+}
+
+// nameAnonymous assigns Go names to the anonymous types after their parents
+// are named, and returns the ids of the types whose parents are not declared.
+func (pac *Package) nameAnonymous(anon map[string]*anonType) (excluded []string) {
+	var name func(a *anonType) string
+	name = func(a *anonType) string {
+		if a.decl.GoName() != "" {
+			return a.decl.GoName()
+		}
+		parent := a.parent.GoName()
+		if p, ok := anon[a.parent.Id()]; ok && p.decl == a.parent {
+			parent = name(p)
+		}
+		if parent == "" {
+			return ""
+		}
+		goName := parent + "_" + a.field
+		if !contains(goName, ".") {
+			goName = pac.uniqueName(goName, a.decl.Id())
+		}
+		a.decl.SetGoName(goName)
+		return goName
+	}
+	ids := make([]string, 0, len(anon))
+	for id := range anon {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		if name(anon[id]) == "" {
+			excluded = append(excluded, id)
+		}
+	}
+	return excluded
+}
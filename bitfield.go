@@ -0,0 +1,178 @@
+// Copyright 2014, Hǎiliàng Wáng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cwrap
+
+import (
+	"io"
+	"strconv"
+)
+
+// bitUnit is an unexported integer field of a Go struct that stores adjacent C
+// bitfields.
+type bitUnit struct {
+	name  string
+	start int // byte offset in the struct
+	size  int // bytes
+}
+
+func (u *bitUnit) goType() string {
+	return sprint("uint", u.size*8)
+}
+
+// bitPiece is the part of a bitfield stored in a unit: n bits from bit lo of
+// the unit are the bits from bit shift of the value.
+type bitPiece struct {
+	unit         *bitUnit
+	lo, n, shift int
+}
+
+// bitfieldUnits allocates the storage units of each run of adjacent bitfields,
+// keyed by the index of the first field of the run. A unit is no larger than
+// the types of the bitfields, so the alignment of the struct is kept, and
+// never overlaps the fields around it.
+func (s *Struct) bitfieldUnits() map[int][]*bitUnit {
+	runs := make(map[int][]*bitUnit)
+	n := 0
+	for i := 0; i < len(s.Fields); {
+		if s.Fields[i].bits == 0 {
+			i++
+			continue
+		}
+		j, maxSize := i, 1
+		for ; j < len(s.Fields) && s.Fields[j].bits > 0; j++ {
+			if size := s.Fields[j].Size(); size > maxSize {
+				maxSize = size
+			}
+		}
+		first, last := s.Fields[i], s.Fields[j-1]
+		limit := s.size
+		if j < len(s.Fields) {
+			limit = s.Fields[j].offset / 8
+		}
+		var units []*bitUnit
+		for p, end := first.offset/8, (last.offset+last.bits+7)/8; p < end; {
+			size := maxSize
+			for size > 1 && (p%size != 0 || p+size > limit) {
+				size /= 2
+			}
+			units = append(units, &bitUnit{sprint("bitfield", n), p, size})
+			n++
+			p += size
+		}
+		runs[i] = units
+		i = j
+	}
+	return runs
+}
+
+// writeBitfieldAccessors writes the getters and setters of the bitfields,
+// which mask and shift the bits of the storage units (little-endian).
+func (s *Struct) writeBitfieldAccessors(w io.Writer) {
+	runs := s.bitfieldUnits()
+	var units []*bitUnit
+	for i := range s.Fields {
+		f := &s.Fields[i]
+		if us, ok := runs[i]; ok {
+			units = us
+		}
+		if f.bits == 0 || f.goName == "" || !isNumOrBool(f.EqualType) {
+			continue
+		}
+		ps := f.bitPieces(units)
+		writeComment(w, f.doc)
+		fp(w, "func (s *", s.GoName(), ") ", f.goName, "() ", f.EqualType.GoName(), " {")
+		fpn(w, "v := ")
+		for i, p := range ps {
+			if i > 0 {
+				fpn(w, " | ")
+			}
+			fpn(w, "uint64(s.", p.unit.name, ">>", p.lo, "&", bitMask(p.n), ")<<", p.shift)
+		}
+		fp(w)
+		switch {
+		case f.EqualType.GoName() == "bool":
+			fp(w, "return v != 0")
+		case isSigned(f.EqualType):
+			fp(w, "return ", f.EqualType.GoName(), "(int64(v<<", 64-f.bits, ")>>", 64-f.bits, ")")
+		default:
+			fp(w, "return ", f.EqualType.GoName(), "(v)")
+		}
+		fp(w, "}")
+		fp(w)
+
+		fp(w, "func (s *", s.GoName(), ") Set", f.goName, "(v ", f.EqualType.GoName(), ") {")
+		if f.EqualType.GoName() == "bool" {
+			fp(w, "u := uint64(0)")
+			fp(w, "if v {")
+			fp(w, "u = 1")
+			fp(w, "}")
+		} else {
+			fp(w, "u := uint64(v)")
+		}
+		for _, p := range ps {
+			u := "s." + p.unit.name
+			fp(w, u, " = ", u, "&^(", bitMask(p.n), "<<", p.lo, ") | ",
+				p.unit.goType(), "(u>>", p.shift, "&", bitMask(p.n), ")<<", p.lo)
+		}
+		fp(w, "}")
+		fp(w)
+	}
+}
+
+func (f *StructField) bitPieces(units []*bitUnit) []bitPiece {
+	var ps []bitPiece
+	for _, u := range units {
+		start, end := u.start*8, (u.start+u.size)*8
+		lo, hi := f.offset, f.offset+f.bits
+		if lo < start {
+			lo = start
+		}
+		if hi > end {
+			hi = end
+		}
+		if lo < hi {
+			ps = append(ps, bitPiece{u, lo - start, hi - lo, lo - f.offset})
+		}
+	}
+	return ps
+}
+
+func bitMask(n int) string {
+	if n >= 64 {
+		return "0xFFFFFFFFFFFFFFFF"
+	}
+	return "0x" + strconv.FormatUint(1<<uint(n)-1, 16)
+}
+
+func isNumOrBool(t EqualType) bool {
+	if t == nil {
+		return false
+	}
+	switch r := t.(type) {
+	case *Num, *Enum:
+		return true
+	case *Typedef:
+		return isNumOrBool(r.Root())
+	}
+	return t.GoName() == "bool"
+}
+
+// isSigned returns true if the integer type is signed, where an enum is
+// unsigned unless it has a negative value as gcc does.
+func isSigned(t EqualType) bool {
+	switch r := t.(type) {
+	case *Enum:
+		for _, v := range r.Values {
+			if v.value < 0 {
+				return true
+			}
+		}
+		return false
+	case *Typedef:
+		return isSigned(r.Root())
+	}
+	n := t.GoName()
+	return !hasPrefix(n, "u") && n != "byte" && n != "bool"
+}
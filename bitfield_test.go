@@ -0,0 +1,155 @@
+// Copyright 2014, Hǎiliàng Wáng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cwrap
+
+import (
+	"strings"
+	"testing"
+)
+
+// bitfield returns a bitfield of type t at the bit offset off.
+func bitfield(name string, t EqualType, off, bits int) StructField {
+	return StructField{goName: name, EqualType: t, offset: off, bits: bits}
+}
+
+// unitsString returns the units of each run of bitfields, e.g.
+// "0:bitfield0@1+1,bitfield1@2+2", with the byte offsets and sizes.
+func unitsString(runs map[int][]*bitUnit) string {
+	var ss []string
+	for i := 0; i < 64; i++ {
+		units, ok := runs[i]
+		if !ok {
+			continue
+		}
+		var us []string
+		for _, u := range units {
+			us = append(us, sprint(u.name, "@", u.start, "+", u.size))
+		}
+		ss = append(ss, sprint(i, ":", join(us, ",")))
+	}
+	return join(ss, " ")
+}
+
+// piecesString returns the pieces of a bitfield, e.g. "bitfield0[0:8]<<0",
+// with the bits in the unit and the shift of the value.
+func piecesString(ps []bitPiece) string {
+	var ss []string
+	for _, p := range ps {
+		ss = append(ss, sprint(p.unit.name, "[", p.lo, ":", p.lo+p.n, "]<<", p.shift))
+	}
+	return join(ss, " ")
+}
+
+func TestBitfieldUnits(t *testing.T) {
+	int8_ := NewNum("int8", "C.schar", 1)
+	uint32_ := NewNum("uint32", "C.uint", 4)
+	for _, tc := range []struct {
+		name   string
+		s      *Struct
+		units  string
+		pieces []string // of each bitfield
+		layout string
+	}{
+		{
+			// struct { unsigned a:3, b:5; }
+			name:   "one unit",
+			s:      newStruct(4, bitfield("a", uint32_, 0, 3), bitfield("b", uint32_, 3, 5)),
+			units:  "0:bitfield0@0+4",
+			pieces: []string{"bitfield0[0:3]<<0", "bitfield0[3:8]<<0"},
+			layout: "bitfield0",
+		},
+		{
+			// struct { char c; unsigned a:20; }
+			name:   "straddling units",
+			s:      newStruct(4, field("c", int8_, 0), bitfield("a", uint32_, 8, 20)),
+			units:  "1:bitfield0@1+1,bitfield1@2+2",
+			pieces: []string{"bitfield0[0:8]<<0 bitfield1[0:12]<<8"},
+			layout: "c bitfield0 bitfield1",
+		},
+		{
+			// struct { unsigned a:3; unsigned :0; unsigned b:3; }, the
+			// zero-width bitfield is dropped by newStructFields.
+			name:   "zero-width bitfield",
+			s:      newStruct(8, bitfield("a", uint32_, 0, 3), bitfield("b", uint32_, 32, 3)),
+			units:  "0:bitfield0@0+4,bitfield1@4+4",
+			pieces: []string{"bitfield0[0:3]<<0", "bitfield1[0:3]<<0"},
+			layout: "bitfield0 bitfield1",
+		},
+		{
+			// struct { unsigned a:4; char c; unsigned b:4; }
+			name: "separate runs",
+			s: newStruct(4, bitfield("a", uint32_, 0, 4), field("c", int8_, 1),
+				bitfield("b", uint32_, 16, 4)),
+			units:  "0:bitfield0@0+1 2:bitfield1@2+2",
+			pieces: []string{"bitfield0[0:4]<<0", "bitfield1[0:4]<<0"},
+			layout: "bitfield0 c bitfield1",
+		},
+	} {
+		runs := tc.s.bitfieldUnits()
+		if got := unitsString(runs); got != tc.units {
+			t.Errorf("%s: expect units %q, got %q", tc.name, tc.units, got)
+		}
+		var units []*bitUnit
+		var pieces []string
+		for i, f := range tc.s.Fields {
+			if us, ok := runs[i]; ok {
+				units = us
+			}
+			if f.bits > 0 {
+				pieces = append(pieces, piecesString(f.bitPieces(units)))
+			}
+		}
+		if got, expect := join(pieces, ", "), join(tc.pieces, ", "); got != expect {
+			t.Errorf("%s: expect pieces %q, got %q", tc.name, expect, got)
+		}
+		items, err := tc.s.computeLayout()
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+		} else if got := layoutString(items); got != tc.layout {
+			t.Errorf("%s: expect layout %q, got %q", tc.name, tc.layout, got)
+		}
+	}
+}
+
+func TestBitfieldAccessors(t *testing.T) {
+	s := newStruct(4,
+		bitfield("Signed", NewNum("int32", "C.int", 4), 0, 5),
+		bitfield("Unsigned", NewNum("uint32", "C.uint", 4), 5, 5),
+	)
+	s.goName = "S"
+	code := writeToString(s.writeBitfieldAccessors)
+	for _, expect := range []string{
+		"func (s *S) Signed() int32 {",
+		// sign extended from bit 4
+		"return int32(int64(v<<59)>>59)",
+		"func (s *S) Unsigned() uint32 {",
+		"return uint32(v)",
+		"v := uint64(s.bitfield0>>5&0x1f)<<0",
+		"func (s *S) SetUnsigned(v uint32) {",
+		"s.bitfield0 = s.bitfield0&^(0x1f<<5) | uint32(u>>0&0x1f)<<5",
+	} {
+		if !strings.Contains(code, expect) {
+			t.Errorf("expect %q in\n%s", expect, code)
+		}
+	}
+}
+
+func TestBitfieldSetterCollision(t *testing.T) {
+	s := newStruct(8, bitfield("Mode", NewNum("uint32", "C.uint", 4), 0, 3),
+		field("Flags", NewNum("uint32", "C.uint", 4), 4))
+	methods := Methods{
+		{Function: &Function{goName: "SetMode"}},
+		{Function: &Function{goName: "SetFlags"}},
+	}
+	s.OptimizeFieldNames(methods)
+	// Set<Field> of a bitfield collides with the method, but a normal field
+	// has no setter.
+	if got := s.Fields[0].goName; got != "Mode_" {
+		t.Errorf("expect bitfield renamed to Mode_, got %s", got)
+	}
+	if got := s.Fields[1].goName; got != "Flags" {
+		t.Errorf("expect field Flags kept, got %s", got)
+	}
+}
@@ -0,0 +1,210 @@
+// Copyright 2014, Hǎiliàng Wáng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cwrap
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	gcc "h12.io/go-gccxml"
+)
+
+const bufferQuerySize = "query"
+
+// bufferArg is a char* argument filled by C, which is passed a buffer
+// allocated in C memory with an extra byte for the terminating NUL, and
+// returned as a Go string.
+type bufferArg struct {
+	baseType
+	size  string // Go expression of the size of the buffer
+	query bool   // allocated by bufferQuery
+}
+
+func newBufferArg() *bufferArg {
+	return &bufferArg{baseType: baseType{"string", "*C.char"}}
+}
+
+func (t *bufferArg) ToCgo(w io.Writer, assign, g, c string) {
+	if t.query {
+		fp(w, "var ", c, " *C.char")
+		return
+	}
+	fp(w, c, assign, "=(*C.char)(C.calloc(C.size_t(", t.size, ")+1, 1))")
+	fp(w, "defer C.free(unsafe.Pointer(", c, "))")
+}
+
+func (t *bufferArg) ToGo(w io.Writer, assign, g, c string) {
+	fp(w, g, assign, "=C.GoString(", c, ")")
+}
+
+// bufferLen is the length argument of a buffer, which is set to the size of
+// the buffer rather than passed by Go.
+type bufferLen struct {
+	baseType // cgo type only, so that it is not a Go parameter
+	size     string
+	query    bool // set by bufferQuery
+}
+
+func (t *bufferLen) ToCgo(w io.Writer, assign, g, c string) {
+	if t.query {
+		fp(w, "var ", c, " ", t.CgoName())
+		return
+	}
+	conv(w, assign, t.size, c, t.CgoName())
+}
+
+func (t *bufferLen) ToGo(w io.Writer, assign, g, c string) {
+}
+
+// bufferQuery calls the function with a NULL buffer of 0 length first, and
+// allocates the buffer by the returned length, excluding the terminating NUL
+// as snprintf does.
+type bufferQuery struct {
+	buf, len *Argument
+}
+
+func (q *bufferQuery) before(w io.Writer, f *Function) {
+	buf, n := q.buf.CgoName(), q.buf.CgoName()+"_n"
+	fpn(w, n, " := int(C.", f.cFuncName(), "(")
+	for _, a := range f.CArgs {
+		fpn(w, a.CgoName(), ",")
+	}
+	fp(w, "))")
+	fp(w, "if ", n, " < 0 {")
+	fp(w, n, " = 0")
+	fp(w, "}")
+	fp(w, buf, " = (*C.char)(C.calloc(C.size_t(", n, ")+1, 1))")
+	fp(w, "defer C.free(unsafe.Pointer(", buf, "))")
+	conv(w, "", n+"+1", q.len.CgoName(), q.len.CgoTypeName())
+}
+
+// prepareBuffers settles the sizes of the buffer arguments by ArgRule, from
+//   - the length argument passed by Go, named after "buffer:", e.g.
+//     "buffer:cbGUID" for SDL_GUIDToString,
+//   - a C constant or a number, e.g. "buffer:NC_MAX_NAME",
+//   - or the length returned by calling the function with a NULL buffer
+//     first, "buffer:query".
+//
+// Unless it is named, the length argument is the integer argument right after
+// the buffer if it looks like a size, by a size_t type or a name containing
+// len or size, and it is set to the size of the buffer.
+func (pac *Package) prepareBuffers(functions []*Function) error {
+	gccFuncs := make(map[string]*gcc.Function)
+	for _, fn := range pac.XmlDoc.Functions {
+		gccFuncs[fn.Id()] = fn
+	}
+	for _, f := range functions {
+		fn := gccFuncs[trimSuffix(f.id, "_original")]
+		if fn == nil {
+			continue
+		}
+		for i, a := range f.CArgs {
+			buf, ok := a.type_.(*bufferArg)
+			if !ok {
+				continue
+			}
+			name := f.CName() + "." + fn.Arguments[i].CName()
+			if !pac.isCharBuffer(fn.Arguments[i].CType()) {
+				return fmt.Errorf("ArgRule %s: buffer is not a char* argument", name)
+			}
+			size := pac.argRule(f.CName(), fn.Arguments[i].CName()).size
+			lenIndex := -1
+			for j, b := range fn.Arguments {
+				if size != "" && b.CName() == size && j != i {
+					lenIndex = j
+				}
+			}
+			if lenIndex >= 0 && !isInteger(fn.Arguments[lenIndex].CType()) {
+				return fmt.Errorf("ArgRule %s: length argument %s is not an integer", name, size)
+			}
+			if lenIndex < 0 && i+1 < len(fn.Arguments) && isSizeLike(fn.Arguments[i+1]) {
+				lenIndex = i + 1
+			}
+			var lenArg *Argument
+			if lenIndex >= 0 {
+				lenArg = f.CArgs[lenIndex]
+			}
+
+			switch {
+			case size == "" || lenArg != nil && size == fn.Arguments[lenIndex].CName():
+				if lenArg == nil {
+					return fmt.Errorf("ArgRule %s: no length argument of the buffer, name it by %s<length>",
+						name, bufferPrefix)
+				}
+				buf.size = lenArg.GoName()
+				continue
+			case size == bufferQuerySize:
+				if lenArg == nil || f.Return == nil || !isInteger(fn.ReturnType()) {
+					return fmt.Errorf("ArgRule %s: %s needs a length argument and an integer return value",
+						name, bufferQuerySize)
+				}
+				buf.query = true
+				f.query = &bufferQuery{buf: a, len: lenArg}
+			default:
+				if _, err := strconv.Atoi(size); err == nil {
+					buf.size = size
+				} else {
+					buf.size = "C." + size
+				}
+			}
+			if lenArg != nil {
+				lenArg.type_ = &bufferLen{
+					baseType: baseType{cgoName: lenArg.CgoTypeName()},
+					size:     buf.size,
+					query:    buf.query,
+				}
+				f.GoParams = f.GoParams.Filter(func(_ int, p Param) (Param, bool) {
+					return p, p != Param(lenArg)
+				})
+			}
+		}
+	}
+	return nil
+}
+
+// isCharBuffer returns true if t is a pointer to non-const char.
+func (pac *Package) isCharBuffer(t gcc.Type) bool {
+	pt := pointedType(t)
+	return pt != nil && cNameOf(unalias(pt)) == "char" && !pac.pointsToConst(t)
+}
+
+// isSizeLike returns true if a is an integer argument that looks like the
+// size of a buffer, by a size_t type, e.g. size_t, ssize_t, or by a name
+// containing len or size.
+func isSizeLike(a *gcc.Argument) bool {
+	t := a.CType()
+	if !isInteger(t) {
+		return false
+	}
+	name := strings.ToLower(a.CName())
+	if contains(name, "len") || contains(name, "size") {
+		return true
+	}
+	for {
+		if hasSuffix(cNameOf(t), "size_t") {
+			return true
+		}
+		alias, ok := t.(gcc.Aliased)
+		if !ok {
+			return false
+		}
+		t = alias.Base()
+	}
+}
+
+// isInteger returns true if t is a C integer type, e.g. int, size_t.
+func isInteger(t gcc.Type) bool {
+	ft, ok := unalias(t).(*gcc.FundamentalType)
+	if !ok {
+		return false
+	}
+	switch ft.CName() {
+	case "void", "float", "double", "long double", "bool", "_Bool":
+		return false
+	}
+	return true
+}
@@ -0,0 +1,169 @@
+// Copyright 2014, Hǎiliàng Wáng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cwrap
+
+import (
+	"io"
+	"sort"
+
+	gcc "h12.io/go-gccxml"
+)
+
+// callbackParam is a callback argument of a function paired with the user
+// data argument passed back to the callback.
+type callbackParam struct {
+	*gcc.CallbackInfo
+	dataArg int // index of the user data argument of the function
+}
+
+// callbackParams returns the callback arguments of a function, each paired
+// with the first void* argument after it, or the last one before it if there
+// is not. Callbacks may share a user data argument. Nil is returned unless all
+// the callbacks are paired.
+func (pac *Package) callbackParams(fn *gcc.Function) []callbackParam {
+	var ps []callbackParam
+	for i, a := range fn.Arguments {
+		ft := funcPtrOf(a.CType())
+		if ft == nil {
+			continue
+		}
+		dataIndex := userDataArg(ft)
+		if dataIndex < 0 {
+			return nil
+		}
+		p := callbackParam{
+			CallbackInfo: &gcc.CallbackInfo{
+				ArgIndex:  i,
+				DataIndex: dataIndex,
+				CName:     fn.CName() + "_" + a.CName(),
+				CType:     ft,
+			},
+			dataArg: -1,
+		}
+		for j := i + 1; j < len(fn.Arguments) && p.dataArg < 0; j++ {
+			if isVoidPtr(fn.Arguments[j].CType()) {
+				p.dataArg = j
+			}
+		}
+		for j := i - 1; j >= 0 && p.dataArg < 0; j-- {
+			if isVoidPtr(fn.Arguments[j].CType()) {
+				p.dataArg = j
+			}
+		}
+		if p.dataArg < 0 || a.CName() == "" {
+			return nil
+		}
+		ps = append(ps, p)
+	}
+	return ps
+}
+
+// transformCallbacks returns the function taking Go functions in place of the
+// callbacks and their user data, and the callbacks exported for it. The user
+// data refers to a holder of the Go functions, so that callbacks sharing the
+// same user data are told apart.
+func (pac *Package) transformCallbacks(oriFunc *gcc.Function, ps []callbackParam) (*Function, []CallbackFunc) {
+	fn := pac.newFunction(oriFunc)
+	holder := snakeToLowerCamel(pac.UpperName(fn.CName())) + "Funcs"
+	var callbacks []CallbackFunc
+	var keptHandles Params
+	goArgs := make(map[int]*Argument)
+	members := make(map[int][]string) // by the index of the user data
+	for _, p := range ps {
+		cb := pac.newCallbackFunc(p.CallbackInfo)
+		ca := fn.CArgs[p.ArgIndex]
+		cb.held = &funcMember{holder: holder, member: ca.GoName()}
+		cb.name = fn.CName() + "." + oriFunc.Arguments[p.ArgIndex].CName()
+		callbacks = append(callbacks, cb)
+
+		goArg := cb.callbackArg()
+		goArg.goName = ca.GoName()
+		goArgs[p.ArgIndex] = goArg
+		members[p.dataArg] = append(members[p.dataArg], ca.GoName()+": "+ca.GoName())
+
+		ca.goName = "(*[0]byte)(unsafe.Pointer(" + cgoName(cb.cFuncName) + "))"
+		ca.type_ = &cValue{}
+		ca.isOut = false
+	}
+	var dataArgs []int
+	for i := range members {
+		dataArgs = append(dataArgs, i)
+	}
+	sort.Ints(dataArgs)
+	for _, i := range dataArgs {
+		da, ms := fn.CArgs[i], members[i]
+		keep, owner := false, ""
+		for _, p := range ps {
+			if p.dataArg != i {
+				continue
+			}
+			argName := oriFunc.Arguments[p.ArgIndex].CName()
+			switch rule := pac.callbackRule(fn.CName(), argName); rule.kind {
+			case callbackKeep:
+				keep = true
+			case callbackRetain:
+				if owner == "" {
+					owner = pac.retainOwner(fn, oriFunc, argName, rule)
+				}
+			}
+		}
+		if owner != "" {
+			keep = false
+		}
+		if keep {
+			keptHandles = append(keptHandles, &handleResult{
+				name:    da.goName + "Handle",
+				release: "releaseHandle(" + da.cgoName + "_h)",
+			})
+		}
+		da.goName = "&" + holder + "{" + join(ms, ", ") + "}"
+		da.type_ = &handleArg{keep: keep, owner: owner}
+		da.isOut = false
+	}
+
+	var goParams Params
+	for i, p := range fn.GoParams {
+		if i < len(fn.CArgs) {
+			if a, ok := goArgs[i]; ok {
+				p = a
+			} else if _, ok := members[i]; ok {
+				continue
+			}
+		}
+		goParams = append(goParams, p)
+	}
+	fn.GoParams = append(goParams, keptHandles...)
+	fn.holder = &callbackHolder{name: holder, funcs: callbacks}
+	return fn, callbacks
+}
+
+// callbackHolder is the Go type holding the Go functions passed to a function
+// taking callbacks.
+type callbackHolder struct {
+	name  string
+	funcs []CallbackFunc
+}
+
+func (h *callbackHolder) write(w io.Writer) {
+	writeComment(w, sprint(h.name, " holds the Go functions passed as callbacks, pointed by the user data."))
+	fp(w, "type ", h.name, " struct {")
+	for _, cb := range h.funcs {
+		fp(w, cb.held.member, " ", cb.internalFunc().GoName())
+	}
+	fp(w, "}")
+	fp(w)
+}
+
+// cValue is a C argument converted by the Go expression as is.
+type cValue struct {
+	baseType
+}
+
+func (t *cValue) ToCgo(w io.Writer, assign, g, c string) {
+	fp(w, c, assign, "=", g)
+}
+
+func (t *cValue) ToGo(w io.Writer, assign, g, c string) {
+}
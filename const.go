@@ -0,0 +1,593 @@
+// Copyright 2014, Hǎiliàng Wáng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cwrap
+
+import (
+	"errors"
+	"fmt"
+	"go/constant"
+	"go/token"
+	"go/types"
+	"io"
+	"log"
+	"math/big"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Constant is a Go constant converted from an object-like C macro.
+type Constant struct {
+	baseCNamer
+	goName string
+	goType string // empty if untyped
+	value  string
+}
+
+func (c *Constant) GoName() string {
+	return c.goName
+}
+
+func (c *Constant) SetGoName(n string) {
+	c.goName = n
+}
+
+func (c *Constant) WriteSpec(w io.Writer) {
+	if c.goType != "" {
+		fpn(w, c.goType, " ")
+	}
+	fp(w, "= ", c.value)
+}
+
+// prepareConstants converts the object-like macros of the package to Go
+// constants, must go after all the Go names of types are settled. The C
+// expressions are evaluated by go/types, so an unsupported macro is reported
+// instead of generating code that does not compile.
+func (pac *Package) prepareConstants() error {
+	e, err := pac.newConstEval()
+	if err != nil {
+		return err
+	}
+	declared := NewSSet()
+	pac.TypeDeclMap.Each(func(d TypeDecl) {
+		declared.Add(d.CName())
+		if en, ok := d.(*Enum); ok {
+			for _, v := range en.Values {
+				declared.Add(v.CName())
+			}
+		}
+	})
+	pac.eachFunction(func(f *Function) {
+		declared.Add(f.CName())
+	})
+	for _, v := range pac.Variables {
+		declared.Add(v.CName())
+	}
+
+	var consts []*Constant
+	for _, m := range pac.macros {
+		if m.funcLike || m.body == "" || declared.Has(m.name) || pac.shimmed(m.name) ||
+			!pac.headerFiles.Has(m.file) || !pac.matched(m.name) || pac.excluded(m.name) {
+			continue
+		}
+		v, err := e.eval(m.name)
+		if err != nil {
+			log.Print("skip macro ", m.name, ": ", err)
+			continue
+		}
+		c := &Constant{
+			baseCNamer: baseCNamer{
+				id:    "macro_" + m.name,
+				cName: m.name,
+				doc:   lineDoc(pac.readLines(m.file), m.line),
+			},
+			value: v.goValue(),
+		}
+		if !isUntyped(v.typ) {
+			c.goType = types.TypeString(v.typ, types.RelativeTo(e.pkg))
+		}
+		c.goName = pac.localName(c)
+		consts = append(consts, c)
+	}
+	pac.Constants = consts
+	return nil
+}
+
+// constType is a numeric Go type that a C type maps to.
+type constType struct {
+	goName string // may be a type declared in the package
+	basic  string // the underlying Go type
+}
+
+// constValue is an evaluated macro.
+type constValue struct {
+	typ types.Type
+	val constant.Value
+	hex bool // written in hex in C
+}
+
+func (v *constValue) goValue() string {
+	switch v.val.Kind() {
+	case constant.String:
+		return strconv.Quote(constant.StringVal(v.val))
+	case constant.Float:
+		bits := 64
+		if b, ok := v.typ.Underlying().(*types.Basic); ok && b.Kind() == types.Float32 {
+			bits = 32
+		}
+		f, _ := constant.Float64Val(v.val)
+		s := strconv.FormatFloat(f, 'g', -1, bits)
+		if !strings.ContainsAny(s, ".eIN") {
+			s += ".0"
+		}
+		return s
+	case constant.Int:
+		if i := bigInt(v.val); v.hex && i.Sign() >= 0 {
+			return "0x" + strings.ToUpper(i.Text(16))
+		}
+	}
+	return v.val.ExactString()
+}
+
+// constEval evaluates the macros recursively.
+type constEval struct {
+	pac      *Package
+	macros   map[string]*macro
+	enums    map[string]int
+	cTypes   map[string]constType // by C type name
+	apiTypes map[string]constType // by the prefix of macro names
+	values   map[string]*constValue
+	errs     map[string]error
+	pkg      *types.Package
+}
+
+func (pac *Package) newConstEval() (*constEval, error) {
+	e := &constEval{
+		pac:      pac,
+		macros:   make(map[string]*macro),
+		enums:    make(map[string]int),
+		cTypes:   make(map[string]constType),
+		apiTypes: make(map[string]constType),
+		values:   make(map[string]*constValue),
+		errs:     make(map[string]error),
+		pkg:      types.NewPackage(pac.PacPath, pac.PacName),
+	}
+	for _, m := range pac.macros {
+		if !m.funcLike {
+			e.macros[m.name] = m
+		}
+	}
+	for cName, goName := range cNumTypes() {
+		e.cTypes[cName] = constType{goName, goName}
+	}
+	for cName, goName := range pac.TypeRule {
+		if isNumType(goName) {
+			e.cTypes[cName] = constType{goName, goName}
+		}
+	}
+	for _, em := range pac.Enumerations {
+		for _, v := range em.EnumValues {
+			e.enums[v.CName()] = v.Init()
+		}
+	}
+	pac.TypeDeclMap.Each(func(d TypeDecl) {
+		switch t := d.(type) {
+		case *Typedef:
+			switch r := t.Root().(type) {
+			case *Num:
+				e.addType(t.CName(), t.GoName(), r.GoName())
+			case *Enum:
+				e.addType(t.CName(), t.GoName(), r.baseGoName)
+			}
+		case *Enum:
+			e.addType("enum "+t.CName(), t.GoName(), t.baseGoName)
+		}
+	})
+	// the flags passed to the functions, e.g. SDL_INIT_* to SDL_Init.
+	pac.eachFunction(func(f *Function) {
+		var ts []constType
+		for _, a := range f.CArgs {
+			if t, ok := e.argType(a.type_); ok {
+				ts = append(ts, t)
+			}
+		}
+		if len(ts) == 1 {
+			e.apiTypes[strings.ToUpper(f.CName())+"_"] = ts[0]
+		}
+	})
+	for _, pat := range sortedKeys(pac.ConstTypes) {
+		if _, err := regexp.Compile(pat); err != nil {
+			return nil, Wrapf(err, "ConstTypes: invalid pattern %q", pat)
+		}
+		if _, ok := e.cTypes[pac.ConstTypes[pat]]; !ok {
+			return nil, fmt.Errorf("ConstTypes: %s is not a numeric type", pac.ConstTypes[pat])
+		}
+	}
+	return e, nil
+}
+
+func (e *constEval) addType(cName, goName, basic string) {
+	if !isNumType(basic) {
+		return
+	}
+	if goName == "" || contains(goName, ".") {
+		goName = basic
+	}
+	e.cTypes[cName] = constType{goName, basic}
+	if goName != basic && e.pkg.Scope().Lookup(goName) == nil {
+		tn := types.NewTypeName(token.NoPos, e.pkg, goName, nil)
+		types.NewNamed(tn, types.Universe.Lookup(basic).Type(), nil)
+		e.pkg.Scope().Insert(tn)
+	}
+}
+
+// argType returns the type of an argument if it is a named integer type.
+func (e *constEval) argType(t Type) (constType, bool) {
+	var cName string
+	switch a := t.(type) {
+	case *Typedef:
+		cName = a.CName()
+	case *Enum:
+		cName = "enum " + a.CName()
+	case *Num:
+		cName = trimPrefix(a.CgoName(), "C.")
+		if _, ok := e.pac.TypeRule[cName]; !ok {
+			return constType{}, false
+		}
+	default:
+		return constType{}, false
+	}
+	ct, ok := e.cTypes[cName]
+	if !ok || strings.HasPrefix(ct.basic, "float") {
+		return constType{}, false
+	}
+	return ct, true
+}
+
+// constTypeOf returns the configured type of a macro, or the type of the
+// argument of the function it is named after.
+func (e *constEval) constTypeOf(name string) (constType, bool) {
+	for _, pat := range sortedKeys(e.pac.ConstTypes) {
+		if regexp.MustCompile(pat).MatchString(name) {
+			return e.cTypes[e.pac.ConstTypes[pat]], true
+		}
+	}
+	// the longest prefix
+	var t constType
+	n := 0
+	for prefix, pt := range e.apiTypes {
+		if hasPrefix(name, prefix) && len(prefix) > n {
+			t, n = pt, len(prefix)
+		}
+	}
+	return t, n > 0
+}
+
+func (e *constEval) eval(name string) (*constValue, error) {
+	if v, ok := e.values[name]; ok {
+		if v == nil {
+			return nil, errors.New("recursive definition")
+		}
+		return v, nil
+	}
+	if err, ok := e.errs[name]; ok {
+		return nil, err
+	}
+	e.values[name] = nil // evaluating
+	v, err := e.evalMacro(e.macros[name])
+	if err != nil {
+		delete(e.values, name)
+		e.errs[name] = err
+		return nil, err
+	}
+	e.values[name] = v
+	e.pkg.Scope().Insert(types.NewConst(token.NoPos, e.pkg, name, v.typ, v.val))
+	return v, nil
+}
+
+func (e *constEval) evalMacro(m *macro) (*constValue, error) {
+	toks, err := cTokens(m.body)
+	if err != nil {
+		return nil, err
+	}
+	expr, err := e.expr(toks)
+	if err != nil {
+		return nil, err
+	}
+	v, err := e.evalExpr(expr)
+	if err != nil {
+		return nil, err
+	}
+	if t, ok := e.constTypeOf(m.name); ok && isUntyped(v.typ) && v.val.Kind() != constant.String {
+		if v, err = e.evalExpr(e.convert(t, v.val)); err != nil {
+			return nil, err
+		}
+	}
+	v.hex = contains(strings.ToLower(m.body), "0x")
+	return v, nil
+}
+
+func (e *constEval) evalExpr(expr string) (*constValue, error) {
+	tv, err := types.Eval(token.NewFileSet(), e.pkg, token.NoPos, expr)
+	if err != nil {
+		return nil, err
+	}
+	if tv.Value == nil {
+		return nil, fmt.Errorf("%s is not a constant", expr)
+	}
+	return &constValue{typ: tv.Type, val: tv.Value}, nil
+}
+
+// convert returns the Go expression converting a constant to a type, where an
+// integer out of the range is truncated as C does.
+func (e *constEval) convert(t constType, v constant.Value) string {
+	if v.Kind() == constant.Int && !strings.HasPrefix(t.basic, "float") {
+		basic := types.Universe.Lookup(t.basic).Type().(*types.Basic)
+		bits := uint(types.SizesFor("gc", "amd64").Sizeof(basic) * 8)
+		i := bigInt(v)
+		mod := new(big.Int).Lsh(big.NewInt(1), bits)
+		i.Mod(i, mod)
+		if basic.Info()&types.IsUnsigned == 0 && i.Cmp(new(big.Int).Rsh(mod, 1)) >= 0 {
+			i.Sub(i, mod)
+		}
+		return t.goName + "(" + i.String() + ")"
+	}
+	if v.Kind() == constant.Float {
+		// ExactString is a fraction, e.g. 3/2, which is an integer division
+		f, _ := constant.Float64Val(v)
+		return t.goName + "(" + strconv.FormatFloat(f, 'g', -1, 64) + ")"
+	}
+	return t.goName + "(" + v.ExactString() + ")"
+}
+
+// expr translates the tokens of a C expression to a Go expression.
+func (e *constEval) expr(toks []string) (string, error) {
+	var out []string
+	operand := false // the last token ends an operand
+	for i := 0; i < len(toks); i++ {
+		t := toks[i]
+		if operand && (isCIdent(t) || t[0] == '"' || t[0] == '(' && e.isCast(toks[i:])) {
+			// adjacent string literals
+			out = append(out, "+")
+		}
+		operand = true
+		switch {
+		case t == "(":
+			j := matchParen(toks, i)
+			if j < 0 {
+				return "", errors.New("unbalanced parentheses")
+			}
+			if ct, ok := e.castType(toks[i+1 : j]); ok {
+				k := operandEnd(toks, j+1)
+				if k < 0 {
+					return "", errors.New("cast without operand")
+				}
+				inner, err := e.expr(toks[j+1 : k])
+				if err != nil {
+					return "", err
+				}
+				v, err := e.evalExpr(inner)
+				if err != nil {
+					return "", err
+				}
+				out = append(out, e.convert(ct, v.val))
+				i = k - 1
+				continue
+			}
+			inner, err := e.expr(toks[i+1 : j])
+			if err != nil {
+				return "", err
+			}
+			out = append(out, "("+inner+")")
+			i = j
+		case t[0] == '"' || t[0] == '\'':
+			out = append(out, t)
+		case t[0] >= '0' && t[0] <= '9' || t[0] == '.':
+			out = append(out, e.number(t))
+		case isCIdent(t):
+			s, err := e.ident(t)
+			if err != nil {
+				return "", err
+			}
+			out = append(out, s)
+		case t == "~":
+			out = append(out, "^")
+			operand = false
+		case t == "?" || t == ":" || t == ",":
+			return "", fmt.Errorf("operator %s is not supported", t)
+		default:
+			out = append(out, t)
+			operand = false
+		}
+	}
+	return join(out, " "), nil
+}
+
+func (e *constEval) ident(name string) (string, error) {
+	if _, ok := e.macros[name]; ok {
+		if _, err := e.eval(name); err != nil {
+			return "", fmt.Errorf("%s: %v", name, err)
+		}
+		return name, nil
+	}
+	if v, ok := e.enums[name]; ok {
+		return strconv.Itoa(v), nil
+	}
+	return "", fmt.Errorf("%s is not a constant", name)
+}
+
+var (
+	hexLitPat = regexp.MustCompile(`\A\(?\s*0[xX]`)
+	cTokenPat = regexp.MustCompile(`"(?:[^"\\]|\\.)*"|'(?:[^'\\]|\\.)*'|` +
+		`0[xX][0-9a-fA-F]+[uUlL]*|(?:\d+\.?\d*|\.\d+)(?:[eE][+-]?\d+)?[fFlLuU]*|` +
+		`[A-Za-z_]\w*|<<|>>|<=|>=|==|!=|&&|\|\||[-+*/%&|^~!<>()?:,]`)
+)
+
+// cTokens splits a C expression into tokens.
+func cTokens(s string) ([]string, error) {
+	var toks []string
+	for {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			return toks, nil
+		}
+		loc := cTokenPat.FindStringIndex(s)
+		if loc == nil || loc[0] != 0 {
+			return nil, fmt.Errorf("unexpected %q", s)
+		}
+		toks = append(toks, s[:loc[1]])
+		s = s[loc[1]:]
+	}
+}
+
+// number translates a C number literal to Go, the suffix of an unsigned integer
+// becomes a conversion.
+func (e *constEval) number(t string) string {
+	if !hexLitPat.MatchString(t) && strings.ContainsAny(t, ".eE") {
+		return strings.TrimRight(t, "fFlL")
+	}
+	lit := strings.TrimRight(t, "uUlL")
+	suffix := strings.ToLower(t[len(lit):])
+	if !contains(suffix, "u") {
+		return lit
+	}
+	cType := "unsigned int"
+	if contains(suffix, "ll") {
+		cType = "unsigned long long"
+	} else if contains(suffix, "l") {
+		cType = "unsigned long"
+	}
+	return e.cTypes[cType].goName + "(" + lit + ")"
+}
+
+func (e *constEval) isCast(toks []string) bool {
+	j := matchParen(toks, 0)
+	if j < 0 {
+		return false
+	}
+	_, ok := e.castType(toks[1:j])
+	return ok
+}
+
+// castType returns the type of the tokens in a C cast.
+func (e *constEval) castType(toks []string) (constType, bool) {
+	var words []string
+	for _, t := range toks {
+		if !isCIdent(t) {
+			return constType{}, false
+		}
+		if t != "const" {
+			words = append(words, t)
+		}
+	}
+	t, ok := e.cTypes[join(words, " ")]
+	return t, ok
+}
+
+// matchParen returns the index of the parenthesis closing toks[i].
+func matchParen(toks []string, i int) int {
+	depth := 0
+	for j := i; j < len(toks); j++ {
+		switch toks[j] {
+		case "(":
+			depth++
+		case ")":
+			depth--
+			if depth == 0 {
+				return j
+			}
+		}
+	}
+	return -1
+}
+
+// operandEnd returns the end of the operand starting at toks[i].
+func operandEnd(toks []string, i int) int {
+	for i < len(toks) && strings.Contains("-+~!", toks[i]) {
+		i++
+	}
+	if i >= len(toks) {
+		return -1
+	}
+	if toks[i] == "(" {
+		j := matchParen(toks, i)
+		if j < 0 {
+			return -1
+		}
+		return j + 1
+	}
+	return i + 1
+}
+
+var cIdentOnlyPat = regexp.MustCompile(`\A[A-Za-z_]\w*\z`)
+
+func isCIdent(s string) bool {
+	return cIdentOnlyPat.MatchString(s)
+}
+
+func isUntyped(t types.Type) bool {
+	b, ok := t.(*types.Basic)
+	return ok && b.Info()&types.IsUntyped != 0
+}
+
+func isNumType(goName string) bool {
+	obj := types.Universe.Lookup(goName)
+	if obj == nil {
+		return false
+	}
+	b, ok := obj.Type().(*types.Basic)
+	return ok && b.Info()&types.IsNumeric != 0 && b.Info()&types.IsComplex == 0
+}
+
+func bigInt(v constant.Value) *big.Int {
+	switch i := constant.Val(v).(type) {
+	case int64:
+		return big.NewInt(i)
+	case *big.Int:
+		return new(big.Int).Set(i)
+	}
+	return new(big.Int)
+}
+
+// Go types of C numeric types, assuming the data model of the machine.
+func cNumTypes() map[string]string {
+	long := sprint("int", MachineSize*8)
+	return map[string]string{
+		"char":                   "int8",
+		"signed char":            "int8",
+		"unsigned char":          "uint8",
+		"short":                  "int16",
+		"short int":              "int16",
+		"unsigned short":         "uint16",
+		"unsigned short int":     "uint16",
+		"int":                    "int32",
+		"signed":                 "int32",
+		"signed int":             "int32",
+		"unsigned":               "uint32",
+		"unsigned int":           "uint32",
+		"long":                   long,
+		"long int":               long,
+		"unsigned long":          "u" + long,
+		"unsigned long int":      "u" + long,
+		"long long":              "int64",
+		"long long int":          "int64",
+		"unsigned long long":     "uint64",
+		"unsigned long long int": "uint64",
+		"float":                  "float32",
+		"double":                 "float64",
+		"int8_t":                 "int8",
+		"uint8_t":                "uint8",
+		"int16_t":                "int16",
+		"uint16_t":               "uint16",
+		"int32_t":                "int32",
+		"uint32_t":               "uint32",
+		"int64_t":                "int64",
+		"uint64_t":               "uint64",
+		"size_t":                 "u" + long,
+		"ptrdiff_t":              long,
+		"intptr_t":               long,
+		"uintptr_t":              "u" + long,
+	}
+}
@@ -0,0 +1,172 @@
+// Copyright 2014, Hǎiliàng Wáng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cwrap
+
+import (
+	"go/constant"
+	"go/types"
+	"strings"
+	"testing"
+)
+
+// newTestEval returns the evaluator of the object-like macros by their names
+// and bodies, with the C numeric types only.
+func newTestEval(macros map[string]string) *constEval {
+	e := &constEval{
+		pac:      &Package{},
+		macros:   make(map[string]*macro),
+		enums:    map[string]int{"RED": 1},
+		cTypes:   make(map[string]constType),
+		apiTypes: make(map[string]constType),
+		values:   make(map[string]*constValue),
+		errs:     make(map[string]error),
+		pkg:      types.NewPackage("test", "test"),
+	}
+	for name, body := range macros {
+		e.macros[name] = &macro{name: name, body: body}
+	}
+	for cName, goName := range cNumTypes() {
+		e.cTypes[cName] = constType{goName, goName}
+	}
+	return e
+}
+
+func TestCTokens(t *testing.T) {
+	for _, tc := range []struct {
+		expr string
+		toks string
+		err  bool
+	}{
+		{expr: "(1<<4)|0x10u", toks: "( 1 << 4 ) | 0x10u"},
+		{expr: `"a" "b\"c"`, toks: `"a" "b\"c"`},
+		{expr: "1.5e3f + .5", toks: "1.5e3f + .5"},
+		{expr: "(unsigned long)-1L", toks: "( unsigned long ) - 1L"},
+		{expr: "A>=B&&!C", toks: "A >= B && ! C"},
+		{expr: "'a' + 1", toks: "'a' + 1"},
+		{expr: "a @ b", err: true},
+		{expr: "a = b", err: true},
+	} {
+		toks, err := cTokens(tc.expr)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%s: expect an error, got %q", tc.expr, toks)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.expr, err)
+			continue
+		}
+		if got := strings.Join(toks, " "); got != tc.toks {
+			t.Errorf("%s: expect tokens %q, got %q", tc.expr, tc.toks, got)
+		}
+	}
+}
+
+func TestEvalMacro(t *testing.T) {
+	e := newTestEval(map[string]string{
+		"UNSIGNED":        "10u",
+		"UNSIGNED_LONG":   "10ul",
+		"UNSIGNED_LL":     "10ULL",
+		"LONG":            "10L",
+		"CAST":            "((int)3)",
+		"SHIFT":           "(1 << 4) | 1",
+		"TRUNCATED":       "(unsigned char)0x1FF",
+		"SIGNED":          "(signed char)255",
+		"HEX":             "0x1f",
+		"NEGATIVE_HEX":    "(int)0xFFFFFFFF",
+		"FLOAT":           "1.5f",
+		"COMPLEMENT":      "~0u",
+		"FLOAT_CAST":      "(float)1.5",
+		"STRINGS":         `"foo" "bar"`,
+		"STRING_MACROS":   `STRINGS "baz"`,
+		"DEPENDENT":       "SHIFT + 1",
+		"ENUM":            "RED << 1",
+		"CONDITIONAL":     "1 ? 2 : 3",
+		"COMMA":           "(1, 2)",
+		"UNKNOWN":         "UNDEFINED + 1",
+		"UNKNOWN_DEP":     "UNKNOWN * 2",
+		"RECURSIVE":       "RECURSIVE + 1",
+		"ASSIGN":          "x = 1",
+		"BAD_CAST":        "(struct s)1",
+		"UNBALANCED":      "(1 + 2",
+		"CAST_NO_OPERAND": "(int)",
+	})
+	unsignedLong := cNumTypes()["unsigned long"]
+	for _, tc := range []struct {
+		name  string
+		value string
+		typ   string
+		err   string
+	}{
+		{name: "UNSIGNED", value: "10", typ: "uint32"},
+		{name: "UNSIGNED_LONG", value: "10", typ: unsignedLong},
+		{name: "UNSIGNED_LL", value: "10", typ: "uint64"},
+		{name: "LONG", value: "10", typ: "untyped int"},
+		{name: "CAST", value: "3", typ: "int32"},
+		{name: "SHIFT", value: "17", typ: "untyped int"},
+		{name: "TRUNCATED", value: "0xFF", typ: "uint8"},
+		{name: "SIGNED", value: "-1", typ: "int8"},
+		{name: "HEX", value: "0x1F", typ: "untyped int"},
+		{name: "NEGATIVE_HEX", value: "-1", typ: "int32"},
+		{name: "FLOAT", value: "1.5", typ: "untyped float"},
+		{name: "COMPLEMENT", value: "4294967295", typ: "uint32"},
+		{name: "FLOAT_CAST", value: "1.5", typ: "float32"},
+		{name: "STRINGS", value: `"foobar"`, typ: "untyped string"},
+		{name: "STRING_MACROS", value: `"foobarbaz"`, typ: "untyped string"},
+		{name: "DEPENDENT", value: "18", typ: "untyped int"},
+		{name: "ENUM", value: "2", typ: "untyped int"},
+		{name: "CONDITIONAL", err: "operator ? is not supported"},
+		{name: "COMMA", err: "operator , is not supported"},
+		{name: "UNKNOWN", err: "UNDEFINED is not a constant"},
+		{name: "UNKNOWN_DEP", err: "UNKNOWN: UNDEFINED is not a constant"},
+		{name: "RECURSIVE", err: "recursive definition"},
+		{name: "ASSIGN", err: `unexpected "= 1"`},
+		{name: "BAD_CAST", err: "struct is not a constant"},
+		{name: "UNBALANCED", err: "unbalanced parentheses"},
+		{name: "CAST_NO_OPERAND", err: "cast without operand"},
+	} {
+		v, err := e.eval(tc.name)
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%s: expect error %q, got %v", tc.name, tc.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if got := v.goValue(); got != tc.value {
+			t.Errorf("%s: expect value %s, got %s", tc.name, tc.value, got)
+		}
+		if got := v.typ.String(); got != tc.typ {
+			t.Errorf("%s: expect type %s, got %s", tc.name, tc.typ, got)
+		}
+	}
+}
+
+func TestConvert(t *testing.T) {
+	e := newTestEval(nil)
+	for _, tc := range []struct {
+		typ  string
+		v    int64
+		expr string
+	}{
+		{"uint8", 256, "uint8(0)"},
+		{"uint8", -1, "uint8(255)"},
+		{"int8", 128, "int8(-128)"},
+		{"int16", -32769, "int16(32767)"},
+		{"uint32", 1 << 32, "uint32(0)"},
+		{"int64", -1, "int64(-1)"},
+	} {
+		if got := e.convert(constType{tc.typ, tc.typ}, constant.MakeInt64(tc.v)); got != tc.expr {
+			t.Errorf("%s(%d): expect %s, got %s", tc.typ, tc.v, tc.expr, got)
+		}
+	}
+	if got := e.convert(constType{"float32", "float32"}, constant.MakeFloat64(1.5)); got != "float32(1.5)" {
+		t.Errorf("expect float32(1.5), got %s", got)
+	}
+}
@@ -0,0 +1,342 @@
+// Copyright 2014, Hǎiliàng Wáng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cwrap
+
+import (
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strings"
+)
+
+var cIdentPat = regexp.MustCompile(`[A-Za-z_][A-Za-z0-9_]*`)
+
+// prepareDocs converts the comments of the C declarations to Go doc comments,
+// must go after all the Go names are settled.
+func (pac *Package) prepareDocs() {
+	goNames := make(map[string]string)
+	addName := func(cName, goName string) {
+		if cName != "" && goName != "" {
+			goNames[cName] = goName
+		}
+	}
+	pac.TypeDeclMap.Each(func(d TypeDecl) {
+		addName(d.CName(), d.GoName())
+		if ms := methodsOf(d); ms != nil {
+			for _, m := range *ms {
+				addName(m.CName(), d.GoName()+"."+m.GoName())
+			}
+		}
+		if e, ok := d.(*Enum); ok {
+			for _, v := range e.Values {
+				if v.valid() {
+					addName(v.CName(), v.GoName())
+				}
+			}
+		}
+	})
+	for _, f := range pac.Functions {
+		addName(f.CName(), f.GoName())
+	}
+	for _, v := range pac.Variables {
+		addName(v.CName(), v.GoName())
+	}
+	convert := func(doc string) string {
+		return cIdentPat.ReplaceAllStringFunc(doc, func(s string) string {
+			if goName, ok := goNames[s]; ok {
+				return goName
+			}
+			return s
+		})
+	}
+	doc := func(id string) string {
+		return convert(pac.cDoc(id))
+	}
+	funcDoc := func(f *Function) string {
+		if f.shim != nil && pac.macroDoc(f.shim.src) != "" {
+			return convert(pac.macroDoc(f.shim.src))
+		}
+		return doc(pac.docId(f))
+	}
+
+	pac.TypeDeclMap.Each(func(d TypeDecl) {
+		switch t := d.(type) {
+		case *Typedef:
+			t.doc = doc(t.id)
+			if c, ok := t.Literal.(CNamer); ok && t.doc == "" {
+				t.doc = doc(c.Id())
+			}
+		case *Struct:
+			t.doc = doc(t.id)
+			for i, f := range t.Fields {
+				t.Fields[i].doc = doc(f.id)
+			}
+		case *Union:
+			t.doc = doc(t.id)
+			for i, f := range t.Fields {
+				t.Fields[i].doc = doc(f.id)
+			}
+		case *Enum:
+			t.doc = doc(t.id)
+			// enum values have no locations in the castxml output
+			lines := pac.headerLines(pac.xmlInfo.attr(t.id, "file"))
+			line := pac.xmlInfo.intAttr(t.id, "line")
+			for i, v := range t.Values {
+				t.Values[i].doc = convert(lineDoc(lines, enumValueLine(lines, line, v.CName())))
+			}
+		}
+		if ms := methodsOf(d); ms != nil {
+			for _, m := range *ms {
+				m.doc = funcDoc(m.Function)
+			}
+		}
+	})
+	for _, f := range pac.Functions {
+		f.doc = funcDoc(f)
+	}
+	for _, v := range pac.Variables {
+		v.doc = doc(v.id)
+	}
+}
+
+// docId returns the id of the C declaration documenting the function.
+func (pac *Package) docId(f *Function) string {
+	if f.shim == nil {
+		return trimSuffix(f.id, "_original")
+	}
+	for _, fn := range pac.XmlDoc.Functions {
+		if fn.CName() == f.shim.src {
+			return fn.Id()
+		}
+	}
+	return ""
+}
+
+// macroDoc returns the comment of a macro.
+func (pac *Package) macroDoc(name string) string {
+	for _, m := range pac.macros {
+		if m.name == name {
+			return lineDoc(pac.readLines(m.file), m.line)
+		}
+	}
+	return ""
+}
+
+// enumValueLine returns the line (1-based) of an enum value found by its name
+// in the body of the enum declared at line, or 0 if it is not found.
+func enumValueLine(lines []string, line int, name string) int {
+	if line <= 0 || name == "" {
+		return 0
+	}
+	for i := line - 1; i < len(lines); i++ {
+		s := strings.TrimSpace(lines[i])
+		if ident := cIdentPat.FindString(s); ident == name && hasPrefix(s, ident) {
+			return i + 1
+		}
+		if contains(s, "}") {
+			break
+		}
+	}
+	return 0
+}
+
+func methodsOf(d TypeDecl) *Methods {
+	switch t := d.(type) {
+	case *Typedef:
+		return &t.Methods
+	case *Struct:
+		return &t.Methods
+	case *Union:
+		return &t.Methods
+	case *Enum:
+		return &t.Methods
+	}
+	return nil
+}
+
+// cDoc returns the comment of a C declaration, either the comment block right
+// above it or the comment following it on the same line.
+func (pac *Package) cDoc(id string) string {
+	lines := pac.headerLines(pac.xmlInfo.attr(id, "file"))
+	return lineDoc(lines, pac.xmlInfo.intAttr(id, "line"))
+}
+
+// lineDoc returns the comment of the declaration at line (1-based).
+func lineDoc(lines []string, line int) string {
+	if line <= 0 || line > len(lines) {
+		return ""
+	}
+	comment := precedingComment(lines, line-1)
+	if comment == nil {
+		comment = trailingComment(lines[line-1])
+	}
+	return join(cleanComment(comment), "\n")
+}
+
+// lines of a header file by its id in the castxml output.
+func (pac *Package) headerLines(fileId string) []string {
+	if fileId == "" {
+		return nil
+	}
+	for _, file := range pac.XmlDoc.Files {
+		if file.Id() == fileId {
+			return pac.readLines(file.CName())
+		}
+	}
+	return nil
+}
+
+// lines of a file, cached by its name.
+func (pac *Package) readLines(file string) []string {
+	if lines, ok := pac.fileLines[file]; ok {
+		return lines
+	}
+	if pac.fileLines == nil {
+		pac.fileLines = make(map[string][]string)
+	}
+	var lines []string
+	if buf, err := ioutil.ReadFile(file); err == nil {
+		lines = strings.Split(string(buf), "\n")
+	}
+	pac.fileLines[file] = lines
+	return lines
+}
+
+func precedingComment(lines []string, i int) []string {
+	// skip the leading part of a declaration split into lines, e.g. the return
+	// type of a function.
+	j := i - 1
+	for k := 0; k < 3 && j >= 0 && isDeclPart(lines[j]); k++ {
+		j--
+	}
+	if j < 0 {
+		return nil
+	}
+	last := strings.TrimSpace(lines[j])
+	switch {
+	case strings.HasSuffix(last, "*/"):
+		k := j
+		for k >= 0 && !contains(lines[k], "/*") {
+			k--
+		}
+		if k < 0 {
+			return nil
+		}
+		start := strings.TrimSpace(lines[k])
+		// a trailing comment of the previous declaration
+		if !hasPrefix(start, "/*") || isTrailingMark(start) {
+			return nil
+		}
+		return lines[k : j+1]
+	case hasPrefix(last, "//"):
+		k := j
+		for k > 0 && hasPrefix(strings.TrimSpace(lines[k-1]), "//") {
+			k--
+		}
+		if isTrailingMark(strings.TrimSpace(lines[k])) {
+			return nil
+		}
+		return lines[k : j+1]
+	}
+	return nil
+}
+
+func isDeclPart(line string) bool {
+	s := strings.TrimSpace(line)
+	if s == "" || hasPrefix(s, "#") || hasPrefix(s, "/") || hasPrefix(s, "*") {
+		return false
+	}
+	for _, suffix := range []string{";", ",", "{", "}", "*/"} {
+		if strings.HasSuffix(s, suffix) {
+			return false
+		}
+	}
+	return true
+}
+
+func trailingComment(line string) []string {
+	i := strings.Index(line, "/*")
+	if j := strings.Index(line, "//"); j >= 0 && (i < 0 || j < i) {
+		i = j
+	}
+	if i <= 0 || strings.TrimSpace(line[:i]) == "" {
+		return nil
+	}
+	return []string{line[i:]}
+}
+
+// Doxygen marks of a comment documenting the declaration before it.
+func isTrailingMark(s string) bool {
+	for _, mark := range []string{"/**<", "/*!<", "///<", "//!<"} {
+		if hasPrefix(s, mark) {
+			return true
+		}
+	}
+	return false
+}
+
+var commentMarks = []string{
+	"/**<", "/*!<", "///<", "//!<", "/**", "/*!", "/*", "///", "//!", "//",
+}
+
+func cleanComment(lines []string) []string {
+	var ss []string
+	for _, line := range lines {
+		s := strings.TrimSpace(line)
+		for _, mark := range commentMarks {
+			if hasPrefix(s, mark) {
+				s = s[len(mark):]
+				break
+			}
+		}
+		if i := strings.Index(s, "*/"); i >= 0 {
+			s = s[:i]
+		}
+		s = strings.TrimSpace(s)
+		if hasPrefix(s, "*") {
+			s = strings.TrimSpace(s[1:])
+		}
+		for _, brief := range []string{`\brief `, "@brief "} {
+			s = trimPrefix(s, brief)
+		}
+		if strings.Trim(s, "*=-/ ") == "" {
+			s = ""
+		}
+		ss = append(ss, s)
+	}
+	for len(ss) > 0 && ss[0] == "" {
+		ss = ss[1:]
+	}
+	for len(ss) > 0 && ss[len(ss)-1] == "" {
+		ss = ss[:len(ss)-1]
+	}
+	return ss
+}
+
+// writeComment writes a Go comment.
+func writeComment(w io.Writer, doc string) {
+	if doc == "" {
+		return
+	}
+	for _, line := range strings.Split(doc, "\n") {
+		if line == "" {
+			fp(w, "//")
+		} else {
+			fp(w, "// ", line)
+		}
+	}
+}
+
+// writeDoc writes the doc comment of a declaration followed by its C name.
+func writeDoc(w io.Writer, doc, cName string) {
+	writeComment(w, doc)
+	if cName == "" {
+		return
+	}
+	if doc != "" {
+		fp(w, "//")
+	}
+	fp(w, "// ", cName)
+}
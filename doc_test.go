@@ -0,0 +1,38 @@
+// Copyright 2014, Hǎiliàng Wáng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cwrap
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEnumValueDoc(t *testing.T) {
+	lines := strings.Split(`/* the blend modes */
+typedef enum
+{
+    /** no blending */
+    SDL_BLENDMODE_NONE = 0x00000000,
+    SDL_BLENDMODE_BLEND = 0x00000001,    /**< alpha blending */
+    SDL_BLENDMODE_ADD,
+    SDL_BLENDMODE_ADDITIVE
+} SDL_BlendMode;
+
+enum { SDL_BLENDMODE_MOD = 4 }; /**< not in the enum */`, "\n")
+	for _, tc := range []struct {
+		name string
+		doc  string
+	}{
+		{"SDL_BLENDMODE_NONE", "no blending"},
+		{"SDL_BLENDMODE_BLEND", "alpha blending"},
+		{"SDL_BLENDMODE_ADD", ""},
+		{"SDL_BLENDMODE_ADDITIVE", ""},
+		{"SDL_BLENDMODE_MOD", ""},
+	} {
+		if doc := lineDoc(lines, enumValueLine(lines, 2, tc.name)); doc != tc.doc {
+			t.Errorf("%s: expect doc %q, got %q", tc.name, tc.doc, doc)
+		}
+	}
+}
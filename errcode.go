@@ -0,0 +1,160 @@
+// Copyright 2014, Hǎiliàng Wáng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cwrap
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+
+	gcc "h12.io/go-gccxml"
+)
+
+// ErrorRule declares the C functions that return a status code, so that their
+// wrappers return a Go error instead.
+type ErrorRule struct {
+	// C names of the return types of the status codes, e.g. "int". Optional,
+	// it narrows the functions matched by Pattern.
+	Types []string
+	// Regexp matching C names of the functions returning status codes.
+	// Required, Types alone would match every function returning them.
+	Pattern string
+	// Status codes meaning success, 0 if empty.
+	Success []int
+	// Optional C function that returns the message of a status code, e.g.
+	// "nc_strerror".
+	Message string
+	// Go name of the generated error type, "Error" if empty.
+	GoName string
+
+	pat        *regexp.Regexp
+	messageArg string
+}
+
+func (pac *Package) initErrorRule() error {
+	r := pac.ErrorRule
+	if r == nil {
+		return nil
+	}
+	if r.Pattern == "" {
+		return errors.New("ErrorRule: Pattern should be set, Types alone would match every function returning them")
+	}
+	pat, err := regexp.Compile(r.Pattern)
+	if err != nil {
+		return Wrapf(err, "ErrorRule: invalid pattern %q", r.Pattern)
+	}
+	r.pat = pat
+	if len(r.Success) == 0 {
+		r.Success = []int{0}
+	}
+	if r.GoName == "" {
+		r.GoName = "Error"
+	}
+	return nil
+}
+
+// returnsError returns true if the function returns a status code according to
+// the ErrorRule.
+func (pac *Package) returnsError(cName string, ret gcc.Type) bool {
+	r := pac.ErrorRule
+	if r == nil || cName == r.Message || gcc.IsVoid(ret) {
+		return false
+	}
+	if len(r.Types) > 0 {
+		named, ok := ret.(gcc.Named)
+		if !ok || !containsString(r.Types, named.CName()) {
+			return false
+		}
+	}
+	return r.pat.MatchString(cName)
+}
+
+func (pac *Package) newErrorReturn(gt gcc.Type) *Return {
+	t := &ErrorCode{
+		goName:  pac.ErrorRule.GoName,
+		cgoName: pac.getType(gt, gcc.NotSet).CgoName(),
+		success: pac.ErrorRule.Success,
+	}
+	return &Return{baseParam{"err", "_ret", t}}
+}
+
+// prepareErrorType finds the Cgo type of the argument of the message function.
+func (pac *Package) prepareErrorType() {
+	r := pac.ErrorRule
+	if r == nil || r.Message == "" {
+		return
+	}
+	r.messageArg = "C.int"
+	for _, fn := range pac.XmlDoc.Functions {
+		if fn.CName() == r.Message && len(fn.Arguments) > 0 {
+			r.messageArg = pac.getType(fn.Arguments[0].CType(), gcc.NotSet).CgoName()
+			break
+		}
+	}
+}
+
+// checkErrorType reserves the name of the error type, must go after the names
+// are settled.
+func (pac *Package) checkErrorType() error {
+	r := pac.ErrorRule
+	if r == nil {
+		return nil
+	}
+	if pac.goNameUsed(r.GoName) || pac.uniqueName(r.GoName, "ErrorRule") != r.GoName {
+		return fmt.Errorf("ErrorRule: %s is already declared, set GoName to another name", r.GoName)
+	}
+	return nil
+}
+
+// writeErrorType writes the Go error type that carries the status code.
+func (pac *Package) writeErrorType(w io.Writer) {
+	r := pac.ErrorRule
+	if r == nil {
+		return
+	}
+	fp(w, "// ", r.GoName, " is the status code returned by a C function that does not succeed.")
+	fp(w, "type ", r.GoName, " int")
+	fp(w, "")
+	fp(w, "func (e ", r.GoName, ") Error() string {")
+	if r.Message != "" {
+		fp(w, "return C.GoString(C.", r.Message, "(", r.messageArg, "(e)))")
+	} else {
+		fp(w, `return "`, pac.PacName, `: error code " + strconv.Itoa(int(e))`)
+	}
+	fp(w, "}")
+	fp(w, "")
+}
+
+// ErrorCode converts a status code returned from C to a Go error.
+type ErrorCode struct {
+	goName  string
+	cgoName string
+	success []int
+}
+
+func (e *ErrorCode) GoName() string {
+	return "error"
+}
+
+func (e *ErrorCode) CgoName() string {
+	return e.cgoName
+}
+
+func (e *ErrorCode) ToCgo(w io.Writer, assign, g, c string) {
+}
+
+func (e *ErrorCode) ToGo(w io.Writer, assign, g, c string) {
+	fpn(w, "if ")
+	for i, s := range e.success {
+		if i > 0 {
+			fpn(w, "&&")
+		}
+		fpn(w, c, "!=", s)
+	}
+	fp(w, "{")
+	fp(w, g, assign, "=", e.goName, "(", c, ")")
+	fp(w, "}")
+}
@@ -0,0 +1,33 @@
+// Copyright 2014, Hǎiliàng Wáng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cwrap
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestErrorRule(t *testing.T) {
+	pac := &Package{ErrorRule: &ErrorRule{Types: []string{"int"}}}
+	if err := pac.initErrorRule(); err == nil || !strings.Contains(err.Error(), "Pattern should be set") {
+		t.Errorf("expect ErrorRule without Pattern rejected, got %v", err)
+	}
+
+	// SDL_Error is wrapped as Error
+	pac = &Package{
+		ErrorRule:  &ErrorRule{Pattern: `\ASDL_`},
+		localNames: map[string]string{"Error": "f1"},
+	}
+	if err := pac.initErrorRule(); err != nil {
+		t.Fatal(err)
+	}
+	if err := pac.checkErrorType(); err == nil || !strings.Contains(err.Error(), "Error is already declared") {
+		t.Errorf("expect the clash of Error reported, got %v", err)
+	}
+	pac.ErrorRule.GoName = "SDLError"
+	if err := pac.checkErrorType(); err != nil {
+		t.Error(err)
+	}
+}
@@ -35,6 +35,11 @@ var (
 			BoolTypes:     boolTypes,
 		},
 		TypeRule: typeRule,
+		ErrorRule: &ErrorRule{
+			Types:   []string{"int"},
+			Pattern: `(?i:\Anc_)`,
+			Message: "nc_strerror",
+		},
 		Included: []*Package{},
 	}
 
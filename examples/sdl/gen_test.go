@@ -28,6 +28,28 @@ var (
 			BoolTypes:     boolTypes,
 		},
 		TypeRule: typeRule,
+		Macros: map[string]string{
+			"SDL_BUTTON":   "Uint32 SDL_BUTTON(int X)",
+			"SDL_MUSTLOCK": "SDL_bool SDL_MUSTLOCK(SDL_Surface *S)",
+		},
+		TaggedUnions: []TaggedUnion{
+			{
+				Type: "SDL_Event",
+				Tag:  "type",
+				Members: map[string]string{
+					"SDL_QUIT":            "quit",
+					"SDL_WINDOWEVENT":     "window",
+					"SDL_KEYDOWN":         "key",
+					"SDL_KEYUP":           "key",
+					"SDL_TEXTEDITING":     "edit",
+					"SDL_TEXTINPUT":       "text",
+					"SDL_MOUSEMOTION":     "motion",
+					"SDL_MOUSEBUTTONDOWN": "button",
+					"SDL_MOUSEBUTTONUP":   "button",
+					"SDL_MOUSEWHEEL":      "wheel",
+				},
+			},
+		},
 		Included: []*Package{},
 	}
 
@@ -65,6 +87,4 @@ func Test(*testing.T) {
 //	OutputDir += "reg/"
 	c(ttf.Wrap())
 	c(sdl.Wrap())
-	//ttf.GenConst("/dev/stdout")
-	//sdl.GenConst("/dev/stdout")
 }
@@ -0,0 +1,188 @@
+// Copyright 2014, Hǎiliàng Wáng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cwrap
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sort"
+)
+
+// flexArray is the flexible array member at the end of a struct, which is
+// not declared in the Go struct but accessed by a method returning a slice.
+type flexArray struct {
+	field  *StructField
+	elem   EqualType
+	offset int          // bytes
+	count  *StructField // nil if the length is passed to the method
+	free   bool         // Free is generated
+	recv   string       // Go name of the struct returned by Alloc, after its typedef if any
+	alloc  string       // Alloc<Struct>, unique in the package
+}
+
+// prepareFlexArrays finds the flexible array members, must go after the names
+// are settled and before the layouts are computed.
+func (pac *Package) prepareFlexArrays() error {
+	used := make(map[string]bool)
+	var structs []*Struct
+	decls := make(map[*Struct][]TypeDecl) // the struct and its typedefs
+	for _, d := range pac.TypeDeclMap.ToSlice() {
+		s := structOf(d)
+		if s == nil || len(s.Fields) == 0 || d.Id() == "" || d.GoName() == "" ||
+			pac.excluded(d.CName()) || contains(d.GoName(), ".") {
+			continue
+		}
+		if s.flex != nil {
+			decls[s] = append(decls[s], d)
+			if _, ok := d.(*Typedef); ok {
+				s.flex.recv = d.GoName()
+			}
+			continue
+		}
+		f := &s.Fields[len(s.Fields)-1]
+		a, ok := f.EqualType.(*Array)
+		if !ok || f.goName == "" || f.offset < 0 {
+			continue
+		}
+		key := d.CName() + "." + pac.xmlInfo.attr(f.id, "name")
+		count, declared := pac.FlexArrays[key]
+		if !declared && !pac.flexible(f) {
+			continue
+		}
+		used[key] = true
+		if a.elementType == nil || a.elementType.Size() <= 0 {
+			if declared {
+				return fmt.Errorf("FlexArrays %s: size of the element type is unknown", key)
+			}
+			log.Print("skip the flexible array member ", key, ": size of the element type is unknown")
+			continue
+		}
+		flex := &flexArray{field: f, elem: a.elementType, offset: f.offset / 8, recv: d.GoName()}
+		if count != "" {
+			flex.count = pac.structField(s, count)
+			if flex.count == nil || !isNumOrBool(flex.count.EqualType) ||
+				flex.count.EqualType.GoName() == "bool" {
+				return fmt.Errorf("FlexArrays %s: count %s is not an integer field", key, count)
+			}
+		}
+		s.flex = flex
+		structs = append(structs, s)
+		decls[s] = append(decls[s], d)
+	}
+	// Alloc<Struct> is package level, and Free must not collide with the
+	// methods or fields.
+	for _, s := range structs {
+		flex := s.flex
+		flex.alloc = pac.uniqueName("Alloc"+flex.recv, flex.field.id)
+		flex.free = !s.Methods.Has("Free")
+		for _, d := range decls[s] {
+			flex.free = flex.free && !methodsOf(d).Has("Free")
+		}
+		for _, f := range s.Fields {
+			flex.free = flex.free && f.goName != "Free"
+		}
+		if !flex.free {
+			log.Print("skip Free of ", flex.recv, ": Free is declared")
+		}
+	}
+	var unused []string
+	for key := range pac.FlexArrays {
+		if !used[key] {
+			unused = append(unused, key)
+		}
+	}
+	if len(unused) > 0 {
+		sort.Strings(unused)
+		return fmt.Errorf("FlexArrays %s are not found", join(unused, ", "))
+	}
+	return nil
+}
+
+// flexible returns true if the field is declared as a flexible array member,
+// T data[] in C99, or T data[0] as a GNU extension.
+func (pac *Package) flexible(f *StructField) bool {
+	t := pac.xmlInfo.attr(f.id, "type")
+	if n := pac.xmlInfo.node(t); n == nil || n.kind != "ArrayType" {
+		return false
+	}
+	return pac.xmlInfo.intAttr(t, "max") < 0
+}
+
+// isFlex returns true if f is the flexible array member of the struct.
+func (s *Struct) isFlex(f *StructField) bool {
+	return s.flex != nil && s.flex.field == f
+}
+
+// writeFlexArray writes the method returning the flexible array member as a
+// slice, the function allocating the struct with room for its elements in C
+// memory, and the method freeing it.
+func (s *Struct) writeFlexArray(w io.Writer) {
+	flex := s.flex
+	if flex == nil {
+		return
+	}
+	name, elem := s.GoName(), flex.elem.GoName()
+	maxLen := (1 << 30) / flex.elem.Size()
+	ptr := sprint("unsafe.Pointer(uintptr(unsafe.Pointer(s)) + ", flex.offset, ")")
+
+	count := ""
+	if flex.count != nil {
+		count = "s." + flex.count.goName
+		if flex.count.bits > 0 {
+			count += "()"
+		}
+		writeComment(w, sprint(flex.field.goName, " returns the flexible array member as a slice of ",
+			trimPrefix(count, "s."), " elements."))
+		fp(w, "func (s *", name, ") ", flex.field.goName, "() []", elem, " {")
+		fp(w, "n := int(", count, ")")
+	} else {
+		writeComment(w, sprint(flex.field.goName, " returns the flexible array member as a slice of n elements."))
+		fp(w, "func (s *", name, ") ", flex.field.goName, "(n int) []", elem, " {")
+	}
+	fp(w, "return (*[", maxLen, "]", elem, ")(", ptr, ")[:n:n]")
+	fp(w, "}")
+	fp(w)
+
+	if name != flex.recv {
+		// Alloc is written once for the struct and its typedef
+		return
+	}
+	doc := sprint(flex.alloc, " allocates a ", name, " in C memory with room for n elements of ",
+		flex.field.goName)
+	if flex.count != nil {
+		doc += sprint(" and sets ", trimPrefix(count, "s."), " to n")
+	}
+	doc += "."
+	if flex.free {
+		doc += " It is freed by Free."
+	}
+	writeComment(w, doc)
+	fp(w, "func ", flex.alloc, "(n int) *", name, " {")
+	fp(w, "size := ", flex.offset, " + n*", flex.elem.Size())
+	fp(w, "if size < ", s.Size(), " {")
+	fp(w, "size = ", s.Size())
+	fp(w, "}")
+	fp(w, "s := (*", name, ")(C.calloc(1, C.size_t(size)))")
+	if flex.count != nil {
+		countType := flex.count.EqualType.GoName()
+		if flex.count.bits > 0 {
+			fp(w, "s.Set", flex.count.goName, "(", countType, "(n))")
+		} else {
+			fp(w, "s.", flex.count.goName, " = ", countType, "(n)")
+		}
+	}
+	fp(w, "return s")
+	fp(w, "}")
+	fp(w)
+
+	if flex.free {
+		writeComment(w, sprint("Free frees the ", name, " allocated by ", flex.alloc, "."))
+		fp(w, "func (s *", name, ") Free() {")
+		fp(w, "C.free(unsafe.Pointer(s))")
+		fp(w, "}")
+		fp(w)
+	}
+}
@@ -34,10 +34,12 @@ func (f *baseFunc) ToCgo(w io.Writer, assign, g, c string) {
 	conv(w, assign, g, c, f.CgoName())
 }
 
+// ToGo converts the user data passed back to a callback to the Go function
+// referred by the handle.
 func (f *baseFunc) ToGo(w io.Writer, assign, g, c string) {
-	fpn(w, g, assign, "=*(*")
+	fpn(w, g, assign, "=handleValue(uintptr(", c, ")).(")
 	f.WriteSpec(w)
-	fp(w, ")(", c, ")")
+	fp(w, ")")
 }
 
 func (f *baseFunc) goCall(w io.Writer, funcName string) {
@@ -70,6 +72,23 @@ type Function struct {
 	goName string
 	baseCNamer
 	baseFunc
+	shim *shim
+	// holder of the Go functions passed as callbacks
+	holder *callbackHolder
+	// releases the Go functions retained by the first argument
+	release *retainRelease
+	// takes the reference returned by the function
+	keep *refKeep
+	// allocates the buffer by the size returned by a query call
+	query *bufferQuery
+}
+
+// cFuncName returns the name of the C function to call.
+func (f *Function) cFuncName() string {
+	if f.shim != nil {
+		return f.shim.name
+	}
+	return f.CName()
 }
 
 func (f *Function) GoName() string {
@@ -93,16 +112,29 @@ func (f *Function) signature(w io.Writer) {
 func (f *Function) body(w io.Writer) {
 	fp(w, "{")
 	f.initCArgs(w)
-	f.cgoCall(w, f.CName())
+	if f.query != nil {
+		f.query.before(w, f)
+	}
+	if f.release != nil {
+		f.release.before(w, f)
+	}
+	f.cgoCall(w, f.cFuncName())
+	if f.release != nil {
+		f.release.after(w, f)
+	}
+	if f.keep != nil {
+		f.keep.write(w, f)
+	}
 	f.returns(w)
 	fp(w, "}")
 }
 
 func (f *Function) returns(w io.Writer) {
-	if f.Return != nil {
-		f.Return.ToGo(w, "")
+	out := f.GoParams.Out()
+	for _, a := range out {
+		a.ToGo(w, "")
 	}
-	if len(f.GoParams.Out()) > 0 {
+	if len(out) > 0 {
 		fp(w, "return")
 	}
 }
@@ -141,7 +173,7 @@ type Method struct {
 }
 
 func (m *Method) Declare(w io.Writer) {
-	fp(w, "// ", m.CName())
+	writeDoc(w, m.doc, m.CName())
 	m.signature(w)
 	m.body(w)
 }
@@ -220,6 +252,9 @@ func (a *baseParam) Type() Type {
 			case *ReturnPtr:
 				return &ReturnPtr{NewNum("int", t.pointedType.CgoName(),
 					MachineSize)}
+			case *InOutPtr:
+				return &InOutPtr{ReturnPtr{NewNum("int", t.pointedType.CgoName(),
+					MachineSize)}}
 			default:
 				return NewNum("int", t.CgoName(), MachineSize)
 			}
@@ -276,6 +311,27 @@ type ReceiverArg struct {
 	EqualType ReceiverType
 }
 
+// InOutResult is the result that returns the value updated by C through an
+// InOutPtr argument.
+type InOutResult struct {
+	*Argument
+}
+
+func (r *InOutResult) GoName() string {
+	return r.Argument.GoName() + "_"
+}
+
+func (r *InOutResult) IsOut() bool {
+	return true
+}
+
+func (r *InOutResult) ToCgo(w io.Writer, assign string) {
+}
+
+func (r *InOutResult) ToGo(w io.Writer, assign string) {
+	fp(w, r.GoName(), assign, "=", r.Argument.GoName())
+}
+
 type Return struct {
 	baseParam
 }
@@ -290,6 +346,19 @@ type CallbackFunc struct {
 	CallbackIndex int
 	baseFunc
 	CType *gccxml.FunctionType
+	// the member of the holder of Go functions pointed by the user data, nil
+	// if the user data points to the Go function
+	held *funcMember
+	// the pool of trampolines passing the slot of the Go function instead of
+	// the user data, nil if the callback has user data
+	pool *trampolinePool
+	// the callback type shared by functions, or function.argument or
+	// struct.field, reported to PanicHandler
+	name string
+	// function.argument of the functions sharing the callback
+	uses []string
+	// Go expression returned to C on panic, zero if empty
+	panicReturn string
 }
 
 func (f CallbackFunc) Declare(w io.Writer) {
@@ -298,10 +367,27 @@ func (f CallbackFunc) Declare(w io.Writer) {
 	f.body(w)
 }
 
+// recoverPanic writes the deferred call recovering a panic of the Go function,
+// which would otherwise unwind through C frames.
+func (f CallbackFunc) recoverPanic(w io.Writer) {
+	fp(w, "defer func() {")
+	fp(w, "if v := recover(); v != nil {")
+	fp(w, "handlePanic(\"", f.name, "\", v)")
+	if f.Return != nil && f.panicReturn != "" {
+		fp(w, f.Return.CgoName(), " = ", f.panicReturn)
+	}
+	fp(w, "}")
+	fp(w, "}()")
+}
+
 func (f CallbackFunc) signature(w io.Writer) {
 	fpn(w, "func ")
 	fpn(w, f.goName)
-	cgoParamDeclList(w, f.CArgs.ToParams()...)
+	params := f.CArgs.ToParams()
+	if f.pool != nil {
+		params = append(Params{NewArgument("slot", "slot", NewNum("int", "C.int", 4))}, params...)
+	}
+	cgoParamDeclList(w, params...)
 	if f.Return != nil {
 		cgoParamDeclList(w, f.Return)
 	}
@@ -309,15 +395,23 @@ func (f CallbackFunc) signature(w io.Writer) {
 
 func (f CallbackFunc) body(w io.Writer) {
 	fp(w, "{")
+	f.recoverPanic(w)
 	f.initGoArgs(w)
-	f.internalFunc().goCall(w, f.callbackArg().GoName())
+	f.internalFunc().goCall(w, f.closureName())
 	f.returns(w)
 	fp(w, "}")
 
 }
 
 func (f CallbackFunc) initGoArgs(w io.Writer) {
-	f.callbackArg().ToGo(w, ":")
+	if f.pool != nil {
+		fp(w, f.closureName(), ":=", f.pool.goName, ".get(int(slot)).(", f.internalFunc().GoName(), ")")
+	} else if f.held != nil {
+		ca := f.CArgs[f.CallbackIndex]
+		fp(w, ca.GoName(), ":=handleValue(uintptr(", ca.CgoName(), ")).(*", f.held.holder, ").", f.held.member)
+	} else {
+		f.callbackArg().ToGo(w, ":")
+	}
 	for i, a := range f.CArgs {
 		if i != f.CallbackIndex {
 			a.ToGo(w, ":")
@@ -325,6 +419,14 @@ func (f CallbackFunc) initGoArgs(w io.Writer) {
 	}
 }
 
+// closureName returns the name of the Go function called by the callback.
+func (f CallbackFunc) closureName() string {
+	if f.pool != nil {
+		return "goFunc"
+	}
+	return f.callbackArg().GoName()
+}
+
 func (f CallbackFunc) returns(w io.Writer) {
 	for _, a := range f.GoParams.Out() {
 		a.ToCgo(w, "")
@@ -0,0 +1,310 @@
+// Copyright 2014, Hǎiliàng Wáng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cwrap
+
+import (
+	"io"
+	"log"
+
+	gcc "h12.io/go-gccxml"
+)
+
+// funcStruct is a struct with function pointer fields, which are called by
+// shims and set to Go functions kept in a holder referred by the handle in the
+// user data field of the struct, e.g. the context of MQTTAsync_connectOptions.
+type funcStruct struct {
+	id     string // of the C struct
+	data   string // C name of the user data field
+	fields []*funcField
+
+	// settled after the Go names
+	recv      string
+	holder    string
+	dataField *StructField
+}
+
+// funcField is a function pointer field set to a Go function, which is called
+// by the exported callback through the C stub of cFuncName.
+type funcField struct {
+	owner     *funcStruct
+	cName     string
+	cFuncName string
+	fn        *baseFunc
+
+	// settled after the Go names
+	field *StructField
+	*funcMember
+}
+
+// eachFuncField visits the function pointer fields of the exported structs
+// with the C types of the structs.
+func (pac *Package) eachFuncField(visit func(cType string, s *gcc.Struct, f *gcc.Field, ft *gcc.FunctionType)) {
+	typedefs := make(map[string]string)
+	for _, id := range pac.xmlInfo.ids("Typedef") {
+		t := pac.xmlInfo.attr(id, "type")
+		if _, ok := typedefs[t]; !ok {
+			typedefs[t] = pac.xmlInfo.attr(id, "name")
+		}
+	}
+	for _, id := range pac.xmlInfo.ids("Struct") {
+		name, cType := pac.xmlInfo.attr(id, "name"), "struct "+pac.xmlInfo.attr(id, "name")
+		if name == "" {
+			name, cType = typedefs[id], typedefs[id]
+		}
+		if name == "" || !pac.exported(name, pac.xmlInfo.attr(id, "file")) {
+			continue
+		}
+		s := pac.FindStruct(id)
+		if s == nil {
+			continue
+		}
+		for _, f := range s.Fields() {
+			if ft := funcPtrOf(f.CType()); ft != nil && f.CName() != "" {
+				visit(cType, s, f, ft)
+			}
+		}
+	}
+}
+
+// funcFieldShims returns the shims calling the function pointer fields, e.g.
+// MQTTAsync_connectOptions_call_onSuccess.
+func (pac *Package) funcFieldShims() []*shim {
+	var shims []*shim
+	pac.eachFuncField(func(cType string, s *gcc.Struct, f *gcc.Field, ft *gcc.FunctionType) {
+		params, args := pac.cParams(ft.Arguments)
+		params = append([]string{cType + " *s"}, params...)
+		cName := trimPrefix(cType, "struct ") + "_call_" + f.CName()
+		name := shimPrefix + cName
+		shims = append(shims, &shim{
+			name:  name,
+			cName: cName,
+			src:   cName,
+			proto: pac.cDecl(ft.ReturnType(), name+"("+join(params, ", ")+")"),
+			body:  cReturn(ft.ReturnType(), "s->"+f.CName()+"("+join(args, ", ")+")"),
+		})
+	})
+	return shims
+}
+
+// fieldCallbacks returns the callbacks exported for the function pointer
+// fields that can be set to Go functions, which have a void* argument to pass
+// the user data field of the struct back.
+func (pac *Package) fieldCallbacks() []CallbackFunc {
+	pac.funcStructs = nil
+	var callbacks []CallbackFunc
+	var fs *funcStruct
+	pac.eachFuncField(func(cType string, s *gcc.Struct, f *gcc.Field, ft *gcc.FunctionType) {
+		name := trimPrefix(cType, "struct ")
+		if fs == nil || fs.id != s.Id() {
+			fs = &funcStruct{id: s.Id(), data: userDataField(s)}
+			if fs.data == "" {
+				log.Print("skip setting the function pointers of ", name,
+					": no single void* field to hold Go functions")
+			} else {
+				pac.funcStructs = append(pac.funcStructs, fs)
+			}
+		}
+		if fs.data == "" {
+			return
+		}
+		dataIndex := userDataArg(ft)
+		if dataIndex < 0 {
+			log.Print("skip setting ", name, ".", f.CName(),
+				": no single void* argument to pass the user data")
+			return
+		}
+		cb := pac.newCallbackFunc(&gcc.CallbackInfo{
+			DataIndex: dataIndex,
+			CName:     name + "_" + f.CName(),
+			CType:     ft,
+		})
+		ff := &funcField{owner: fs, cName: f.CName(), cFuncName: cb.cFuncName,
+			fn: cb.internalFunc(), funcMember: &funcMember{}}
+		fs.fields = append(fs.fields, ff)
+		cb.held = ff.funcMember
+		cb.name = name + "." + f.CName()
+		callbacks = append(callbacks, cb)
+	})
+	return callbacks
+}
+
+// prepareFuncStructs resolves the Go names of the structs with function
+// pointer fields, and removes the callbacks of the structs not declared in
+// Go. It must go after all the Go names are settled.
+func (pac *Package) prepareFuncStructs() {
+	for _, fs := range pac.funcStructs {
+		for _, d := range pac.TypeDeclMap.ToSlice() {
+			s := structOf(d)
+			if s == nil || s.Id() != fs.id || d.GoName() == "" || contains(d.GoName(), ".") {
+				continue
+			}
+			fs.recv = d.GoName()
+			fs.holder = snakeToLowerCamel(fs.recv) + "Funcs"
+			fs.dataField = pac.structField(s, fs.data)
+			for _, ff := range fs.fields {
+				ff.field = pac.structField(s, ff.cName)
+				if ff.field != nil && fs.dataField != nil {
+					ff.holder = fs.holder
+					ff.member = snakeToLowerCamel(ff.field.goName)
+				}
+			}
+			break
+		}
+	}
+	callbacks := pac.Callbacks[:0]
+	for _, cb := range pac.Callbacks {
+		if cb.held == nil || cb.held.member != "" {
+			callbacks = append(callbacks, cb)
+		}
+	}
+	pac.Callbacks = callbacks
+}
+
+func (ff *funcField) resolved() bool {
+	return ff.owner.recv != "" && ff.owner.dataField != nil && ff.field != nil
+}
+
+// hasFuncStructs returns true if any setter of function pointer fields is
+// written.
+func (pac *Package) hasFuncStructs() bool {
+	for _, fs := range pac.funcStructs {
+		if len(fs.resolvedFields()) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// writeFuncStructs writes the holders of the Go functions and the setters of
+// the function pointer fields.
+func (pac *Package) writeFuncStructs(w io.Writer) {
+	if !pac.hasFuncStructs() {
+		return
+	}
+	for _, fs := range pac.funcStructs {
+		fs.write(w)
+	}
+}
+
+func (fs *funcStruct) resolvedFields() []*funcField {
+	var fields []*funcField
+	for _, ff := range fs.fields {
+		if ff.resolved() {
+			fields = append(fields, ff)
+		}
+	}
+	return fields
+}
+
+func (fs *funcStruct) write(w io.Writer) {
+	fields := fs.resolvedFields()
+	if len(fields) == 0 {
+		return
+	}
+	data := fs.dataField.goName
+	writeComment(w, sprint(fs.holder, " holds the Go functions set to the function pointers of ",
+		fs.recv, ", referred by the handle in ", data, "."))
+	fp(w, "type ", fs.holder, " struct {")
+	for _, ff := range fields {
+		fp(w, ff.member, " ", ff.fn.GoName())
+	}
+	fp(w, "}")
+	fp(w)
+
+	fp(w, "func (s *", fs.recv, ") funcs() *", fs.holder, " {")
+	fp(w, "if h, ok := handleValue(s.", data, ").(*", fs.holder, "); ok {")
+	fp(w, "return h")
+	fp(w, "}")
+	fp(w, "h := &", fs.holder, "{}")
+	fp(w, "s.", data, " = newHandle(h)")
+	fp(w, "return h")
+	fp(w, "}")
+	fp(w)
+
+	writeComment(w, "ReleaseFuncs releases the Go functions set to s, after C no longer calls them.")
+	fp(w, "func (s *", fs.recv, ") ReleaseFuncs() {")
+	fp(w, "releaseHandle(s.", data, ")")
+	fp(w, "s.", data, " = 0")
+	fp(w, "}")
+	fp(w)
+
+	for _, ff := range fields {
+		goName := ff.field.goName
+		writeComment(w, sprint("Set", goName, " sets ", goName, " to call f, which is held by ", data,
+			" until ReleaseFuncs is called, so ", data, " must not be set otherwise."))
+		fp(w, "func (s *", fs.recv, ") Set", goName, "(f ", ff.fn.GoName(), ") {")
+		fp(w, "s.funcs().", ff.member, " = f")
+		fp(w, "s.", goName, " = (", ff.field.EqualType.GoName(), ")(unsafe.Pointer(C.", ff.cFuncName, "))")
+		fp(w, "}")
+		fp(w)
+	}
+}
+
+// funcPtrOf returns the function type pointed by t, or nil if t is not a
+// function pointer.
+func funcPtrOf(t gcc.Type) *gcc.FunctionType {
+	pt, ok := unalias(t).(*gcc.PointerType)
+	if !ok {
+		return nil
+	}
+	ft, _ := unalias(pt.PointedType()).(*gcc.FunctionType)
+	return ft
+}
+
+// unalias returns the type under the typedefs and qualifiers of t.
+func unalias(t gcc.Type) gcc.Type {
+	for {
+		a, ok := t.(gcc.Aliased)
+		if !ok {
+			return t
+		}
+		t = a.Base()
+	}
+}
+
+// isVoidPtr returns true if t is void*, which is uintptr in Go.
+func isVoidPtr(t gcc.Type) bool {
+	if c, ok := t.(*gcc.CvQualifiedType); ok {
+		t = c.Base()
+	}
+	pt, ok := t.(*gcc.PointerType)
+	return ok && gcc.IsVoid(pt.PointedType())
+}
+
+// userDataField returns the C name of the only void* field of the struct.
+func userDataField(s *gcc.Struct) string {
+	name := ""
+	for _, f := range s.Fields() {
+		if isVoidPtr(f.CType()) {
+			if name != "" {
+				return ""
+			}
+			name = f.CName()
+		}
+	}
+	return name
+}
+
+// userDataArg returns the index of the only void* argument of the function
+// type, or -1 if there is not.
+func userDataArg(ft *gcc.FunctionType) int {
+	index := -1
+	for i, a := range ft.Arguments {
+		if isVoidPtr(a.CType()) {
+			if index >= 0 {
+				return -1
+			}
+			index = i
+		}
+	}
+	return index
+}
+
+// funcMember is the member of a holder of Go functions, which is pointed by the
+// user data passed to C.
+type funcMember struct {
+	holder string // Go type name
+	member string
+}
@@ -0,0 +1,132 @@
+// Copyright 2014, Hǎiliàng Wáng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cwrap
+
+import (
+	"io"
+)
+
+// handleArg is a user data argument converted from a Go value by a handle, an
+// integer referring to the value in a registry, so that C never keeps a Go
+// pointer. The handle is released when the function returns unless it is kept
+// or retained by CallbackRule.
+type handleArg struct {
+	baseType
+	keep  bool
+	owner string // cgo name of the C object retaining the handle
+}
+
+func (t *handleArg) ToCgo(w io.Writer, assign, g, c string) {
+	fp(w, c, "_h := newHandle(", g, ")")
+	if t.owner != "" {
+		fp(w, "retain(", t.owner, ", func() { releaseHandle(", c, "_h) })")
+	} else if !t.keep {
+		fp(w, "defer releaseHandle(", c, "_h)")
+	}
+	fp(w, c, assign, "=C.cwrap_handle(C.uintptr_t(", c, "_h))")
+}
+
+func (t *handleArg) ToGo(w io.Writer, assign, g, c string) {
+}
+
+// handleResult returns the CallbackHandle releasing a Go function kept for C.
+type handleResult struct {
+	name    string
+	release string // Go statement releasing the Go function
+}
+
+func (r *handleResult) GoName() string      { return r.name }
+func (r *handleResult) CgoName() string     { return "" }
+func (r *handleResult) GoTypeName() string  { return "*CallbackHandle" }
+func (r *handleResult) CgoTypeName() string { return "" }
+func (r *handleResult) IsOut() bool         { return true }
+
+func (r *handleResult) ToCgo(w io.Writer, assign string) {
+}
+
+func (r *handleResult) ToGo(w io.Writer, assign string) {
+	fp(w, r.name, assign, "= &CallbackHandle{release: func() { ", r.release, " }}")
+}
+
+// usesHandles returns true if any Go value is passed to C by a handle.
+func (pac *Package) usesHandles() bool {
+	for _, cb := range pac.Callbacks {
+		if cb.pool == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// hasCallbackHandle returns true if any Go function is kept by CallbackRule.
+func (pac *Package) hasCallbackHandle() bool {
+	has := false
+	pac.eachFunction(func(f *Function) {
+		for _, p := range f.GoParams {
+			if _, ok := p.(*handleResult); ok {
+				has = true
+			}
+		}
+	})
+	return has
+}
+
+// writeCHandle writes the C function converting a handle to the user data,
+// which is done in C because converting an integer to unsafe.Pointer in Go is
+// invalid.
+func (pac *Package) writeCHandle(w io.Writer) {
+	if !pac.usesHandles() {
+		return
+	}
+	fp(w, "#include <stdint.h>")
+	fp(w, "static inline void *cwrap_handle(uintptr_t h) { return (void *)h; }")
+}
+
+// writeHandles writes the registry of the handles and CallbackHandle.
+func (pac *Package) writeHandles(w io.Writer) {
+	if pac.usesHandles() {
+		fp(w, `// handles keeps the Go values passed to C as user data, which are referred by
+// integers so that C never keeps a Go pointer.
+var handles = struct {
+	sync.Mutex
+	m    map[uintptr]interface{}
+	next uintptr
+}{m: make(map[uintptr]interface{})}
+
+func newHandle(v interface{}) uintptr {
+	handles.Lock()
+	defer handles.Unlock()
+	handles.next++
+	handles.m[handles.next] = v
+	return handles.next
+}
+
+func handleValue(h uintptr) interface{} {
+	handles.Lock()
+	defer handles.Unlock()
+	return handles.m[h]
+}
+
+func releaseHandle(h uintptr) {
+	handles.Lock()
+	delete(handles.m, h)
+	handles.Unlock()
+}`)
+		fp(w)
+	}
+	if pac.hasCallbackHandle() {
+		fp(w, `// CallbackHandle refers to a Go function kept for C until it is released.
+type CallbackHandle struct {
+	once    sync.Once
+	release func()
+}
+
+// Release releases the Go function after C no longer calls it.
+func (h *CallbackHandle) Release() {
+	h.once.Do(h.release)
+}`)
+		fp(w)
+	}
+}
@@ -12,6 +12,7 @@ type CNamer interface {
 	Id() string
 	CName() string
 	File() string
+	Doc() string
 }
 
 type GoNamer interface {
@@ -133,6 +134,7 @@ type baseCNamer struct {
 	id    string
 	cName string
 	file  string
+	doc   string
 }
 
 func (e baseCNamer) Id() string {
@@ -147,6 +149,10 @@ func (e baseCNamer) File() string {
 	return e.file
 }
 
+func (e baseCNamer) Doc() string {
+	return e.doc
+}
+
 type Conv interface {
 	ToCgo(w io.Writer, assign, g, c, ctype string)
 	ToGo(w io.Writer, assign, g, c, gtype string)
@@ -0,0 +1,315 @@
+// Copyright 2014, Hǎiliàng Wáng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cwrap
+
+import (
+	"fmt"
+	"io"
+)
+
+// layoutItem is a field of a Go struct: a struct field, a storage unit of
+// bitfields or padding.
+type layoutItem struct {
+	field *StructField
+	unit  *bitUnit
+	pad   int
+}
+
+// prepareLayouts lays out the Go structs by the field offsets reported by
+// castxml, with explicit padding where Go and C alignment differ. A struct that
+// cannot be laid out like C fails the generation.
+func (pac *Package) prepareLayouts() error {
+	for _, d := range pac.TypeDeclMap.ToSlice() {
+		if pac.excluded(d.CName()) || contains(d.GoName(), ".") {
+			continue
+		}
+		var err error
+		if s := structOf(d); s != nil {
+			s.cAlign = pac.cAlign(s.Id())
+			s.layout, err = s.computeLayout()
+		} else if u := unionOf(d); u != nil {
+			u.cAlign = pac.cAlign(u.Id())
+		}
+		if err == nil && goAlign(d) > MachineSize {
+			err = fmt.Errorf("alignment %d is not supported by Go", goAlign(d))
+		}
+		if err != nil {
+			return fmt.Errorf("cannot lay out %s like C, add it to Excluded to skip it: %v",
+				d.CName(), err)
+		}
+	}
+	return nil
+}
+
+// cAlign returns the alignment of a C struct or union, 0 if unknown.
+func (pac *Package) cAlign(id string) int {
+	if align := pac.xmlInfo.intAttr(id, "align"); align > 0 {
+		return align / 8
+	}
+	return 0
+}
+
+// alignField returns the zero-size field that aligns a Go struct like C, or
+// an empty string if it is not needed.
+func alignField(align int) string {
+	if align <= 1 {
+		return ""
+	}
+	return sprint("_ [0]uint", align*8)
+}
+
+// unionOf returns the union declared by d.
+func unionOf(d TypeDecl) *Union {
+	switch t := d.(type) {
+	case *Union:
+		return t
+	case *Typedef:
+		if u, ok := t.Literal.(*Union); ok {
+			return u
+		}
+	}
+	return nil
+}
+
+// structOf returns the struct declared by d.
+func structOf(d TypeDecl) *Struct {
+	switch t := d.(type) {
+	case *Struct:
+		return t
+	case *Typedef:
+		if s, ok := t.Literal.(*Struct); ok {
+			return s
+		}
+	}
+	return nil
+}
+
+func (s *Struct) computeLayout() ([]layoutItem, error) {
+	var items []layoutItem
+	off := 0
+	// place a field at its C offset
+	place := func(name string, cOff, size, align int) error {
+		if cOff < 0 {
+			cOff = roundUp(off, align)
+		}
+		goOff := roundUp(off, align)
+		if goOff < cOff {
+			items = append(items, layoutItem{pad: cOff - off})
+			goOff = roundUp(cOff, align)
+		}
+		if goOff != cOff {
+			return fmt.Errorf("%s is at offset %d in C but %d in Go", name, cOff, goOff)
+		}
+		off = goOff + size
+		return nil
+	}
+	runs := s.bitfieldUnits()
+	for i := range s.Fields {
+		f := &s.Fields[i]
+		for _, u := range runs[i] {
+			if err := place(u.name, u.start, u.size, u.size); err != nil {
+				return items, err
+			}
+			items = append(items, layoutItem{unit: u})
+		}
+		if f.bits > 0 || s.isFlex(f) {
+			continue
+		}
+		if f.EqualType == nil {
+			return items, fmt.Errorf("type of %s is unknown", f.goName)
+		}
+		cOff := -1
+		if f.offset >= 0 {
+			cOff = f.offset / 8
+		}
+		if err := place(f.goName, cOff, f.Size(), goAlign(f.EqualType)); err != nil {
+			return items, err
+		}
+		items = append(items, layoutItem{field: f})
+	}
+	if s.size > 0 {
+		align := s.goAlign()
+		end := roundUp(off, align)
+		if end < s.size {
+			items = append(items, layoutItem{pad: s.size - off})
+			end = roundUp(s.size, align)
+		}
+		if end != s.size {
+			return items, fmt.Errorf("size is %d in C but %d in Go", s.size, end)
+		}
+	}
+	return items, nil
+}
+
+// items returns the layout of the struct, computed on demand if it is not
+// prepared.
+func (s *Struct) items() []layoutItem {
+	if s.layout == nil {
+		s.layout, _ = s.computeLayout()
+	}
+	return s.layout
+}
+
+// goAlign returns the alignment of the Go struct, which is raised to the C
+// alignment by a leading zero-size field if its fields are less aligned.
+func (s *Struct) goAlign() int {
+	return maxInt(s.fieldAlign(), s.cAlign)
+}
+
+// fieldAlign returns the alignment of the fields of the Go struct.
+func (s *Struct) fieldAlign() int {
+	a := 1
+	for _, units := range s.bitfieldUnits() {
+		for _, u := range units {
+			a = maxInt(a, u.size)
+		}
+	}
+	for i := range s.Fields {
+		f := &s.Fields[i]
+		if f.bits == 0 && f.EqualType != nil && !s.isFlex(f) {
+			a = maxInt(a, goAlign(f.EqualType))
+		}
+	}
+	return a
+}
+
+// goAlign returns the alignment of the Go type of t.
+func goAlign(t EqualType) int {
+	switch r := t.(type) {
+	case *Typedef:
+		if root := r.Root(); root != nil {
+			return goAlign(root)
+		}
+		return 1
+	case *Struct:
+		return r.goAlign()
+	case *Union:
+		return r.goAlign()
+	case *Array:
+		return goAlign(r.elementType)
+	case *Ptr:
+		return MachineSize
+	case *Num:
+		if hasPrefix(r.GoName(), "complex") {
+			return minInt(r.Size()/2, MachineSize)
+		}
+	}
+	switch size := t.Size(); size {
+	case 1, 2, 4, 8:
+		return minInt(size, MachineSize)
+	}
+	return 1
+}
+
+// goAlign returns the alignment of the Go union, which is the alignment of the
+// C union, or the largest alignment of its members if it is unknown.
+func (u *Union) goAlign() int {
+	if u.cAlign > 0 {
+		return u.cAlign
+	}
+	a := 1
+	for _, f := range u.Fields {
+		if f.EqualType != nil {
+			a = maxInt(a, goAlign(f.EqualType))
+		}
+	}
+	return a
+}
+
+// writeLayoutTest writes the test checking the sizes and field offsets of the
+// Go structs against the C values.
+func (pac *Package) writeLayoutTest(w io.Writer) {
+	fp(w, "package ", pac.PacName)
+	fp(w, "")
+	fp(w, "import (")
+	fp(w, `"testing"`)
+	fp(w, `"unsafe"`)
+	fp(w, ")")
+	fp(w, "")
+	fp(w, "func TestLayout(t *testing.T) {")
+	for _, d := range pac.layoutDecls() {
+		name := d.GoName()
+		fp(w, "{")
+		fp(w, "var v ", name)
+		fp(w, "if s := unsafe.Sizeof(v); s != ", d.Size(), " {")
+		fp(w, `t.Errorf("size of `, name, ` is %d, expected `, d.Size(), `", s)`)
+		fp(w, "}")
+		if align := pac.cAlign(layoutId(d)); align > 0 {
+			fp(w, "if a := unsafe.Alignof(v); a != ", align, " {")
+			fp(w, `t.Errorf("alignment of `, name, ` is %d, expected `, align, `", a)`)
+			fp(w, "}")
+		}
+		s := structOf(d)
+		if s == nil {
+			fp(w, "}")
+			continue
+		}
+		for _, item := range s.layout {
+			field, off := "", 0
+			switch {
+			case item.unit != nil:
+				field, off = item.unit.name, item.unit.start
+			case item.field != nil && item.field.offset >= 0:
+				field, off = item.field.goName, item.field.offset/8
+				if field == "" {
+					// embedded anonymous member
+					field = item.field.EqualType.GoName()
+				}
+				if field == "" || contains(field, ".") {
+					continue
+				}
+			default:
+				continue
+			}
+			fp(w, "if o := unsafe.Offsetof(v.", field, "); o != ", off, " {")
+			fp(w, `t.Errorf("offset of `, name, ".", field, ` is %d, expected `, off, `", o)`)
+			fp(w, "}")
+		}
+		fp(w, "}")
+	}
+	fp(w, "}")
+}
+
+// layoutDecls returns the struct and union declarations to check in the
+// layout test.
+func (pac *Package) layoutDecls() []TypeDecl {
+	var ds []TypeDecl
+	for _, d := range pac.TypeDeclMap.ToSlice() {
+		if (structOf(d) != nil || unionOf(d) != nil) && d.Size() > 0 && d.GoName() != "" &&
+			!contains(d.GoName(), ".") && !pac.excluded(d.CName()) {
+			ds = append(ds, d)
+		}
+	}
+	return ds
+}
+
+// layoutId returns the id of the struct or union declared by d.
+func layoutId(d TypeDecl) string {
+	if s := structOf(d); s != nil {
+		return s.Id()
+	}
+	if u := unionOf(d); u != nil {
+		return u.Id()
+	}
+	return d.Id()
+}
+
+func roundUp(n, align int) int {
+	return (n + align - 1) / align * align
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,92 @@
+// Copyright 2014, Hǎiliàng Wáng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cwrap
+
+import (
+	"testing"
+)
+
+// field returns a struct field of type t at the byte offset off.
+func field(name string, t EqualType, off int) StructField {
+	return StructField{goName: name, EqualType: t, offset: off * 8}
+}
+
+func newStruct(size int, fields ...StructField) *Struct {
+	return &Struct{baseEqualType: baseEqualType{size: size}, Fields: fields}
+}
+
+// layoutString returns the names of the fields and the sizes of the padding
+// of a layout, e.g. "a pad3 b".
+func layoutString(items []layoutItem) string {
+	var ss []string
+	for _, item := range items {
+		switch {
+		case item.field != nil:
+			ss = append(ss, item.field.goName)
+		case item.unit != nil:
+			ss = append(ss, item.unit.name)
+		default:
+			ss = append(ss, sprint("pad", item.pad))
+		}
+	}
+	return join(ss, " ")
+}
+
+func TestComputeLayout(t *testing.T) {
+	int8_ := NewNum("int8", "C.schar", 1)
+	int32_ := NewNum("int32", "C.int", 4)
+	for _, tc := range []struct {
+		name   string
+		s      *Struct
+		layout string
+		err    string
+	}{
+		{
+			name:   "natural",
+			s:      newStruct(8, field("a", int8_, 0), field("b", int32_, 4)),
+			layout: "a b",
+		},
+		{
+			name:   "padding",
+			s:      newStruct(12, field("a", int8_, 0), field("b", int32_, 8)),
+			layout: "a pad7 b",
+		},
+		{
+			name:   "trailing padding",
+			s:      newStruct(8, field("a", int32_, 0)),
+			layout: "a pad4",
+		},
+		{
+			name: "offset mismatch",
+			s:    newStruct(5, field("a", int8_, 0), field("b", int32_, 1)),
+			err:  "b is at offset 1 in C but 4 in Go",
+		},
+		{
+			name: "size mismatch",
+			s:    newStruct(6, field("a", int32_, 0)),
+			err:  "size is 6 in C but 8 in Go",
+		},
+		{
+			name: "unknown field type",
+			s:    newStruct(4, field("a", nil, 0)),
+			err:  "type of a is unknown",
+		},
+	} {
+		items, err := tc.s.computeLayout()
+		if tc.err != "" {
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("%s: expect error %q, got %v", tc.name, tc.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if got := layoutString(items); got != tc.layout {
+			t.Errorf("%s: expect layout %q, got %q", tc.name, tc.layout, got)
+		}
+	}
+}
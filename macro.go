@@ -0,0 +1,89 @@
+// Copyright 2014, Hǎiliàng Wáng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cwrap
+
+import (
+	"bufio"
+	"io"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// macro is a macro definition dumped by the preprocessor.
+type macro struct {
+	name     string
+	params   []string // parameters of a function-like macro
+	funcLike bool
+	body     string
+	file     string // header file defining the macro
+	line     int
+}
+
+var (
+	defineLinePat = regexp.MustCompile(`\A#define\s+([A-Za-z_]\w*)(\([^)]*\))?\s*(.*)\z`)
+	// line markers like: # 12 "/usr/include/stdio.h" 2
+	lineMarkerPat = regexp.MustCompile(`\A#\s*(\d+)\s+"((?:[^"\\]|\\.)*)"`)
+)
+
+// loadMacros dumps the macros defined in the header files of the package,
+// with the files and lines they are defined at.
+func (pac *Package) loadMacros() error {
+	file := pac.tempFile
+	if file == "" {
+		file = pac.From.FullPath()
+	}
+	args := append(append([]string{}, pac.From.GccXmlArgs...), "-E", "-dD", file)
+	var macros []*macro
+	err := newCmd("castxml", args...).read(func(r io.Reader) error {
+		var err error
+		macros, err = parseMacros(r)
+		return err
+	})
+	if err != nil {
+		return Wrapf(err, "fail to dump macros of %s", file)
+	}
+	pac.macros = nil
+	for _, m := range macros {
+		if pac.headerFiles.Has(m.file) {
+			pac.macros = append(pac.macros, m)
+		}
+	}
+	return nil
+}
+
+// parseMacros parses the output of "-E -dD", i.e. the preprocessed source
+// with line markers and the macro definitions kept.
+func parseMacros(r io.Reader) ([]*macro, error) {
+	var macros []*macro
+	file, line := "", 0
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, 1024*1024)
+	for s.Scan() {
+		text := strings.TrimSpace(s.Text())
+		if m := lineMarkerPat.FindStringSubmatch(text); m != nil {
+			line, _ = strconv.Atoi(m[1])
+			if f, err := strconv.Unquote(`"` + m[2] + `"`); err == nil {
+				file = path.Clean(f)
+			}
+			continue
+		}
+		if m := defineLinePat.FindStringSubmatch(text); m != nil {
+			mc := &macro{name: m[1], body: m[3], file: file, line: line}
+			if m[2] != "" {
+				mc.funcLike = true
+				for _, p := range strings.Split(strings.Trim(m[2], "()"), ",") {
+					if p = strings.TrimSpace(p); p != "" {
+						mc.params = append(mc.params, p)
+					}
+				}
+			}
+			macros = append(macros, mc)
+		}
+		line++
+	}
+	return macros, s.Err()
+}
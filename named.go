@@ -66,6 +66,7 @@ func (e *Enum) WriteMethods(w io.Writer) {
 	fp(w, "const (")
 	for _, v := range e.Values {
 		if v.valid() {
+			writeComment(w, v.doc)
 			fp(w, v.goName, "=", hex(v.value, length))
 		}
 	}
@@ -124,6 +125,9 @@ func (d *Typedef) OptimizeNames() {
 	if s, ok := d.Literal.(*Struct); ok {
 		s.OptimizeFieldNames(d.Methods)
 	}
+	if u, ok := d.Literal.(*Union); ok {
+		u.OptimizeFieldNames(d.Methods)
+	}
 }
 
 func (d *Typedef) WriteSpec(w io.Writer) {
@@ -142,6 +146,11 @@ func (d *Typedef) WriteMethods(w io.Writer) {
 		t.SetGoName(d.GoName())
 		t.WriteMethods(w)
 		t.SetGoName(goName)
+	case *Struct:
+		goName := t.GoName()
+		t.SetGoName(d.GoName())
+		t.WriteMethods(w)
+		t.SetGoName(goName)
 	}
 	d.Methods.WriteMethods(w)
 }
@@ -151,6 +160,9 @@ type Struct struct {
 	baseEqualType
 	Fields []StructField
 	Methods
+	layout []layoutItem
+	cAlign int // 0 if unknown
+	flex   *flexArray
 }
 
 func (s *Struct) OptimizeNames() {
@@ -160,26 +172,72 @@ func (s *Struct) OptimizeNames() {
 
 func (s *Struct) OptimizeFieldNames(methods Methods) {
 	for i, f := range s.Fields {
-		if methods.Has(f.goName) {
+		if methods.Has(f.goName) || f.bits > 0 && methods.Has("Set"+f.goName) {
 			s.Fields[i].goName += "_"
 		}
 	}
 }
 
+// reserveFieldName renames the field named n, e.g. a function pointer named
+// Close, so that the method n can be generated after the field names are
+// optimized.
+func (s *Struct) reserveFieldName(n string, methods Methods) {
+	for i := range s.Fields {
+		if s.Fields[i].goName != n {
+			continue
+		}
+		name := n + "_"
+		for methods.Has(name) || s.hasField(name) {
+			name += "_"
+		}
+		s.Fields[i].goName = name
+	}
+}
+
+func (s *Struct) hasField(goName string) bool {
+	for _, f := range s.Fields {
+		if f.goName == goName {
+			return true
+		}
+	}
+	return false
+}
+
 func (s *Struct) WriteSpec(w io.Writer) {
 	fp(w, "struct {")
-	for _, f := range s.Fields {
-		f.Declare(w)
+	if s.cAlign > s.fieldAlign() {
+		fp(w, alignField(s.cAlign))
+	}
+	for _, item := range s.items() {
+		switch {
+		case item.unit != nil:
+			fp(w, item.unit.name, " ", item.unit.goType())
+		case item.field != nil:
+			item.field.Declare(w)
+		default:
+			fp(w, "_ [", item.pad, "]byte")
+		}
 	}
 	fp(w, "}")
 }
 
+func (s *Struct) WriteMethods(w io.Writer) {
+	s.writeBitfieldAccessors(w)
+	s.writeFlexArray(w)
+	s.Methods.WriteMethods(w)
+}
+
 type StructField struct {
 	goName string
 	EqualType
+	id     string
+	doc    string
+	offset int // in bits
+	bits   int // width of a bitfield, 0 if it is not
 }
 
 func (f *StructField) Declare(w io.Writer) {
+	writeComment(w, f.doc)
 	fp(w, f.goName, " ", f.EqualType.GoName())
 }
 
@@ -188,10 +246,22 @@ type Union struct {
 	baseEqualType
 	Fields []UnionField
 	Methods
+	cAlign int // 0 if unknown
 }
 
 func (s *Union) OptimizeNames() {
 	s.Methods.OptimizeNames(s.GoName())
+	s.OptimizeFieldNames(s.Methods)
+}
+
+// OptimizeFieldNames renames the members whose accessors collide with the
+// methods.
+func (s *Union) OptimizeFieldNames(methods Methods) {
+	for i, f := range s.Fields {
+		if methods.Has(f.goName) || methods.Has("Set"+f.goName) || methods.Has("As"+f.goName) {
+			s.Fields[i].goName += "_"
+		}
+	}
 }
 
 func (s *Union) WriteMethods(w io.Writer) {
@@ -201,34 +271,59 @@ func (s *Union) WriteMethods(w io.Writer) {
 	s.Methods.WriteMethods(w)
 }
 
+// WriteSpec writes the union as bytes aligned like the C union.
 func (s *Union) WriteSpec(w io.Writer) {
-	fp(w, "[", s.size, "]byte")
+	fp(w, "struct {")
+	if f := alignField(s.goAlign()); f != "" {
+		fp(w, f)
+	}
+	fp(w, "_ [", s.size, "]byte")
+	fp(w, "}")
 }
 
 type UnionField struct {
 	goName string
 	EqualType
 	union *Union
+	id    string
+	doc   string
 }
 
 func (f *UnionField) Declare(w io.Writer) {
+	if f.goName == "" || f.EqualType == nil {
+		return
+	}
 	if f.Size() <= MachineSize {
 		f.defineValueGetter(w)
 	} else {
-		f.definePtrGetter(w)
+		f.defineView(w)
 	}
+	f.defineSetter(w)
 }
 
 func (f *UnionField) defineValueGetter(w io.Writer) {
+	writeComment(w, joinDoc(sprint(f.goName, " returns the member ", f.goName, " of the union."), f.doc))
 	fp(w, "func (u *", f.union.GoName(), ")", f.goName, "() ",
 		f.EqualType.GoName(), "{")
 	fp(w, "return ", "*(*", f.EqualType.GoName(), ")(unsafe.Pointer(u))")
 	fp(w, "}")
 }
 
-func (f *UnionField) definePtrGetter(w io.Writer) {
-	fp(w, "func (u *", f.union.GoName(), ")", f.goName, "() *",
+// defineView defines As<Field> of a large member, which is a typed view of
+// the union modified in place.
+func (f *UnionField) defineView(w io.Writer) {
+	writeComment(w, joinDoc(sprint("As", f.goName, " returns the member ", f.goName,
+		" of the union as a pointer,\nwhich modifies the union in place."), f.doc))
+	fp(w, "func (u *", f.union.GoName(), ") As", f.goName, "() *",
 		f.EqualType.GoName(), "{")
 	fp(w, "return ", "(*", f.EqualType.GoName(), ")(unsafe.Pointer(u))")
 	fp(w, "}")
 }
+
+func (f *UnionField) defineSetter(w io.Writer) {
+	writeComment(w, sprint("Set", f.goName, " sets the member ", f.goName, " of the union."))
+	fp(w, "func (u *", f.union.GoName(), ") Set", f.goName, "(v ",
+		f.EqualType.GoName(), ") {")
+	fp(w, "*(*", f.EqualType.GoName(), ")(unsafe.Pointer(u)) = v")
+	fp(w, "}")
+}
@@ -0,0 +1,102 @@
+// Copyright 2014, Hǎiliàng Wáng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cwrap
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sort"
+
+	gcc "h12.io/go-gccxml"
+)
+
+// ownedString is a returned C string owned by the caller, which is copied to
+// Go and then freed.
+type ownedString struct {
+	*String
+	free *refFunc
+	args map[string]string // cgo names of the arguments of the function
+}
+
+func (s *ownedString) ToGo(w io.Writer, assign, g, c string) {
+	s.String.ToGo(w, assign, g, c)
+	fp(w, s.free.call(c, func(a refArg) string { return s.args[a.name] }))
+}
+
+// prepareOwnedStrings makes the functions declared by OwnedStrings free the
+// returned strings, except const char*, which are borrowed. It must go after
+// all the Go names and docs are settled.
+func (pac *Package) prepareOwnedStrings() error {
+	gccFuncs := make(map[string]*gcc.Function)
+	for _, fn := range pac.XmlDoc.Functions {
+		gccFuncs[fn.Id()] = fn
+	}
+	var err error
+	pac.eachFunction(func(f *Function) {
+		if err != nil || f.Return == nil || hasSuffix(f.id, "_original") {
+			return
+		}
+		s, ok := f.Return.type_.(*String)
+		if !ok || gccFuncs[f.id] == nil {
+			return
+		}
+		free := pac.stringFree(f.CName())
+		if free == "" {
+			return
+		}
+		if pac.pointsToConst(gccFuncs[f.id].ReturnType()) {
+			log.Print("skip OwnedStrings ", f.CName(), ": const char* is borrowed")
+			return
+		}
+		rf, e := pac.newRefFunc("OwnedStrings", f.CName(), nil, free)
+		if e != nil {
+			err = e
+			return
+		}
+		args := rf.argsOf(f)
+		if args == nil {
+			err = fmt.Errorf("OwnedStrings %s: no argument for %s", f.CName(), free)
+			return
+		}
+		f.Return.type_ = &ownedString{String: s, free: rf, args: args}
+		f.doc = joinDoc(f.doc, "The returned string is copied and then freed by "+free+".")
+	})
+	if err != nil {
+		return err
+	}
+	var unused []string
+	for _, r := range pac.ownedStrings {
+		if !r.used {
+			unused = append(unused, r.pattern)
+		}
+	}
+	if len(unused) > 0 {
+		sort.Strings(unused)
+		return fmt.Errorf("OwnedStrings %s match no functions returning strings", join(unused, ", "))
+	}
+	return nil
+}
+
+// pointsToConst returns true if t is a pointer to const, e.g. const char*.
+func (pac *Package) pointsToConst(t gcc.Type) bool {
+	pt, ok := unalias(t).(*gcc.PointerType)
+	if !ok {
+		return false
+	}
+	for p := pt.PointedType(); ; {
+		switch a := p.(type) {
+		case *gcc.CvQualifiedType:
+			if pac.xmlInfo.attr(a.Id(), "const") == "1" {
+				return true
+			}
+			p = a.Base()
+		case gcc.Aliased:
+			p = a.Base()
+		default:
+			return false
+		}
+	}
+}
@@ -0,0 +1,347 @@
+// Copyright 2014, Hǎiliàng Wáng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cwrap
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"regexp"
+	"sort"
+
+	gcc "h12.io/go-gccxml"
+)
+
+// constructorPat matches the names of the functions returning new C objects
+// owned by the caller, e.g. cairo_surface_create, SDL_CreateWindow.
+var constructorPat = regexp.MustCompile(`(\A|_)(new|create|open)(_|\z)|(New|Create|Open)`)
+
+// destructorWords pairs the words of constructors with the words of the
+// destructors inferred from them.
+var destructorWords = map[string][]string{
+	"new":    {"free", "destroy", "delete"},
+	"create": {"destroy", "free"},
+	"open":   {"close"},
+	"New":    {"Free", "Destroy", "Delete"},
+	"Create": {"Destroy", "Free"},
+	"Open":   {"Close"},
+}
+
+// owner is a C type whose objects are returned by constructors and owned by
+// the caller until they are freed by the destructor.
+type owner struct {
+	cType        string
+	decl         TypeDecl
+	destructor   *Function
+	method       bool // destructor is a method of decl
+	constructors []*Function
+	finalizer    bool      // the owner setting a finalizer is written
+	ref          *refCount // declared by RefCounts, with no destructor
+}
+
+// prepareOwners pairs the constructors with the destructors of the C types
+// they return, by the naming conventions or Package.Owners. It must go after
+// all the Go names and docs are settled.
+func (pac *Package) prepareOwners() error {
+	pac.owners = nil
+	gccFuncs := make(map[string]*gcc.Function)
+	for _, fn := range pac.XmlDoc.Functions {
+		gccFuncs[fn.Id()] = fn
+	}
+	funcs := make(map[string]*Function)
+	methods := make(map[string]bool)
+	pac.eachFunction(func(f *Function) {
+		if !hasSuffix(f.id, "_original") {
+			funcs[f.CName()] = f
+		}
+	})
+	pac.TypeDeclMap.Each(func(d TypeDecl) {
+		if ms := methodsOf(d); ms != nil {
+			for _, m := range *ms {
+				methods[m.CName()] = true
+			}
+		}
+	})
+	// the C type pointed by the only argument of a destructor
+	freed := func(cName string) gcc.Type {
+		f := funcs[cName]
+		if f == nil || gccFuncs[f.id] == nil || len(gccFuncs[f.id].Arguments) != 1 {
+			return nil
+		}
+		return pointedType(gccFuncs[f.id].Arguments[0].CType())
+	}
+
+	// constructors by the names of the C types they return
+	type constructor struct {
+		f     *Function
+		t     gcc.Type
+		cType string
+		m     []int
+	}
+	var constructors []constructor
+	var cNames []string
+	for cName := range funcs {
+		cNames = append(cNames, cName)
+	}
+	sort.Strings(cNames)
+	for _, cName := range cNames {
+		f, fn := funcs[cName], gccFuncs[funcs[cName].id]
+		m := constructorPat.FindStringSubmatchIndex(cName)
+		if m == nil || fn == nil {
+			continue
+		}
+		t := pointedType(fn.ReturnType())
+		if named, ok := t.(gcc.Named); ok && named.CName() != "" {
+			constructors = append(constructors, constructor{f, t, named.CName(), m})
+		}
+	}
+
+	owners := make(map[string]*owner)
+	used := make(map[string]bool)
+	for _, c := range constructors {
+		cType := c.cType
+		if _, ok := owners[cType]; ok {
+			continue
+		}
+		if _, ok := pac.RefCounts[cType]; ok {
+			continue
+		}
+		destructor, declared := pac.Owners[cType]
+		if declared {
+			used[cType] = true
+		} else {
+			destructor = inferDestructor(c.f.CName(), c.m, func(name string) bool {
+				t := freed(name)
+				return t != nil && t.Id() == c.t.Id()
+			})
+		}
+		if destructor == "" {
+			continue
+		}
+		if funcs[destructor] == nil {
+			return fmt.Errorf("Owners %s: destructor %s is not found", cType, destructor)
+		}
+		decl := pac.TypeDeclMap[c.t.Id()]
+		if decl == nil || decl.GoName() == "" || contains(decl.GoName(), ".") || !returns(c.f, decl) {
+			continue
+		}
+		o := &owner{cType: cType, decl: decl, destructor: funcs[destructor],
+			method: methods[destructor]}
+		owners[cType] = o
+		pac.owners = append(pac.owners, o)
+	}
+	for _, c := range constructors {
+		if o := owners[c.cType]; o != nil && returns(c.f, o.decl) {
+			o.constructors = append(o.constructors, c.f)
+		}
+	}
+
+	var unused []string
+	for cType := range pac.Owners {
+		if !used[cType] && pac.Owners[cType] != "" {
+			unused = append(unused, cType)
+		}
+	}
+	if len(unused) > 0 {
+		sort.Strings(unused)
+		return fmt.Errorf("Owners %s are not returned by constructors", join(unused, ", "))
+	}
+	if err := pac.prepareRefCounts(funcs, cNames); err != nil {
+		return err
+	}
+
+	for _, o := range pac.owners {
+		name := o.decl.GoName()
+		if s := structOf(o.decl); s != nil {
+			methods := append(append(Methods{}, *methodsOf(o.decl)...), s.Methods...)
+			if !methodsOf(o.decl).Has("Close") {
+				s.reserveFieldName("Close", methods)
+			}
+			if o.ref != nil && !methodsOf(o.decl).Has("Clone") {
+				s.reserveFieldName("Clone", methods)
+			}
+		}
+		if o.ref != nil {
+			for _, f := range o.constructors {
+				f.doc = joinDoc(f.doc, sprint("The caller owns a reference to the returned ", name,
+					", which must be released by Close."))
+			}
+		} else {
+			for _, f := range o.constructors {
+				f.doc = joinDoc(f.doc, sprint("The caller owns the returned ", name,
+					", which must be freed by Close."))
+			}
+			o.destructor.doc = joinDoc(o.destructor.doc, sprint("It frees the ", name,
+				" owned by the caller, which must not be used afterwards."))
+		}
+		if pac.Finalizers && o.ref != nil && o.ref.drop.hasParams() {
+			log.Print("skip the owner of ", name, ": ", o.ref.Drop, " takes more than the ", name)
+		} else if pac.Finalizers {
+			o.finalizer = !pac.goNameUsed(name+"Owner", "Own"+name)
+			if !o.finalizer {
+				log.Print("skip the owner of ", name, ": ", name, "Owner or Own", name, " is declared")
+			}
+		}
+	}
+	return nil
+}
+
+// inferDestructor returns the destructor paired with the constructor, which
+// is found by replacing the constructor word, with or without the words after
+// it, e.g. cairo_surface_destroy for cairo_surface_create_similar.
+func inferDestructor(constructor string, m []int, exists func(name string) bool) string {
+	start, end := m[4], m[5]
+	if start < 0 {
+		start, end = m[8], m[9]
+	}
+	word := constructor[start:end]
+	for _, d := range destructorWords[word] {
+		for _, name := range []string{
+			constructor[:start] + d + constructor[end:],
+			constructor[:start] + d,
+		} {
+			if exists(name) {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+// returns returns true if f returns a pointer to the declared Go type, rather
+// than uintptr for an opaque type.
+func returns(f *Function, d TypeDecl) bool {
+	return f.Return != nil && f.Return.GoTypeName() == "*"+d.GoName()
+}
+
+// pointedType returns the type pointed by t under qualifiers, or nil if t is
+// not a pointer.
+func pointedType(t gcc.Type) gcc.Type {
+	if t == nil {
+		return nil
+	}
+	pt, ok := unqualified(t).(*gcc.PointerType)
+	if !ok {
+		return nil
+	}
+	return unqualified(pt.PointedType())
+}
+
+// goNameUsed returns true if any of the names is a Go name of a declaration.
+func (pac *Package) goNameUsed(names ...string) bool {
+	used := false
+	pac.TypeDeclMap.Each(func(d TypeDecl) {
+		used = used || containsString(names, d.GoName())
+	})
+	for _, f := range pac.Functions {
+		used = used || containsString(names, f.GoName())
+	}
+	return used
+}
+
+func joinDoc(doc, s string) string {
+	if doc == "" {
+		return s
+	}
+	if s == "" {
+		return doc
+	}
+	return doc + "\n\n" + s
+}
+
+// writeOwners writes Close for the owned types, and the owners setting
+// finalizers if Finalizers is set.
+func (pac *Package) writeOwners(w io.Writer) {
+	for _, o := range pac.owners {
+		o.write(w)
+	}
+}
+
+func (o *owner) write(w io.Writer) {
+	if o.ref != nil {
+		o.writeRefCount(w)
+		o.writeOwner(w, false)
+		return
+	}
+	name := o.decl.GoName()
+	d := o.destructor
+	call := d.GoName() + "(p)"
+	if o.method {
+		call = "p." + d.GoName() + "()"
+	}
+	returnsError := false
+	if out := d.GoParams.Out(); len(out) == 1 && out[0].GoTypeName() == "error" {
+		returnsError = true
+	}
+	if !methodsOf(o.decl).Has("Close") {
+		writeComment(w, sprint("Close frees the ", name, " returned by a constructor, by ", d.CName(), "."))
+		if returnsError {
+			fp(w, "func (p *", name, ") Close() error {")
+			fp(w, "return ", call)
+		} else {
+			fp(w, "func (p *", name, ") Close() {")
+			fp(w, call)
+		}
+		fp(w, "}")
+		fp(w)
+	}
+	o.writeOwner(w, returnsError)
+}
+
+// writeOwner writes the owner setting a finalizer if it is generated.
+func (o *owner) writeOwner(w io.Writer, returnsError bool) {
+	if !o.finalizer {
+		return
+	}
+	name := o.decl.GoName()
+	owner := name + "Owner"
+	writeComment(w, sprint(owner, " owns a ", name, " freed by Close, or by a finalizer as a safety net\n",
+		"when the ", owner, " is garbage collected, since C memory cannot have one.\n",
+		"The ", name, " must be freed by closing the ", owner, " only."))
+	fp(w, "type ", owner, " struct {")
+	fp(w, "*", name)
+	fp(w, "}")
+	fp(w)
+	writeComment(w, sprint("Own", name, " returns the ", owner, " of p returned by a constructor."))
+	fp(w, "func Own", name, "(p *", name, ") *", owner, " {")
+	fp(w, "o := &", owner, "{p}")
+	fp(w, "runtime.SetFinalizer(o, (*", owner, ").Close)")
+	fp(w, "return o")
+	fp(w, "}")
+	fp(w)
+	writeComment(w, sprint("Close frees the ", name, " once."))
+	if returnsError {
+		fp(w, "func (o *", owner, ") Close() error {")
+	} else {
+		fp(w, "func (o *", owner, ") Close() {")
+	}
+	fp(w, "p := o.", name)
+	fp(w, "if p == nil {")
+	if returnsError {
+		fp(w, "return nil")
+	} else {
+		fp(w, "return")
+	}
+	fp(w, "}")
+	fp(w, "o.", name, " = nil")
+	fp(w, "runtime.SetFinalizer(o, nil)")
+	if returnsError {
+		fp(w, "return p.Close()")
+	} else {
+		fp(w, "p.Close()")
+	}
+	fp(w, "}")
+	fp(w)
+}
+
+// hasFinalizers returns true if any owner setting a finalizer is written.
+func (pac *Package) hasFinalizers() bool {
+	for _, o := range pac.owners {
+		if o.finalizer {
+			return true
+		}
+	}
+	return false
+}
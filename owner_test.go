@@ -0,0 +1,23 @@
+// Copyright 2014, Hǎiliàng Wáng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cwrap
+
+import (
+	"testing"
+)
+
+func TestReserveFieldName(t *testing.T) {
+	// struct { void (*Close)(void*); int Close_; }, a vtable of an owned type
+	fn := &Ptr{&Void{}}
+	s := newStruct(16, field("Close", fn, 0), field("Close_", NewNum("int32", "C.int", 4), 8))
+	methods := Methods{{Function: &Function{goName: "Close__"}}}
+	s.reserveFieldName("Close", methods)
+	if got := s.Fields[0].goName; got != "Close___" {
+		t.Errorf("expect field Close renamed to Close___, got %s", got)
+	}
+	if got := s.Fields[1].goName; got != "Close_" {
+		t.Errorf("expect field Close_ kept, got %s", got)
+	}
+}
@@ -67,19 +67,112 @@ type Package struct {
 	CFile    string
 	HFile    string
 	TypeRule map[string]string
-	ArgRule  map[string]string
+	// ArgRule forces the mapping of pointer arguments, keyed by
+	// "function.argument" (wildcards allowed, e.g. "nc_inq_*.name"), valued by
+	// one of: in, out, inout, string, slice, sliceslice, opaque, buffer (see
+	// README). A key matching no argument is an error.
+	ArgRule map[string]string
+	// CallbackRule sets how long the Go functions passed as callbacks are kept
+	// for C, keyed like ArgRule, valued by one of: call (until the function
+	// returns, by default), keep (until the returned handle is released),
+	// retain:<release function> (until the release function is called with the
+	// first argument of the function, e.g. "retain:MQTTAsync_destroy").
+	CallbackRule map[string]string
+	// CallbackPoolSize is the number of C trampolines generated for each
+	// callback without user data, 8 if it is 0.
+	CallbackPoolSize int
+	// PanicReturn sets the values returned to C by the callbacks when their Go
+	// functions panic, keyed like ArgRule ("function.argument", or
+	// "struct.field" for function pointer fields) or by the C name of a
+	// callback type shared by functions, valued by Go expressions, e.g.
+	// "C.MQTTASYNC_FAILURE". The zero value is returned by default. A key
+	// matching no callback, or conflicting with another key of a shared
+	// callback, is an error.
+	PanicReturn map[string]string
+	// Owners sets the destructors of the C types returned by constructors,
+	// keyed by C type names, valued by the destructors or "" if the types are
+	// not owned. By default, a constructor named with new, create or open is
+	// paired with a destructor named with free, destroy, delete or close, e.g.
+	// cairo_surface_create and cairo_surface_destroy.
+	Owners map[string]string
+	// Finalizers generates an owner type for each owned type, which sets a
+	// finalizer freeing the C object as a safety net.
+	Finalizers bool
+	// RefCounts declares the reference counted types, keyed by C type names,
+	// e.g. "cairo_t": {Keep: "cairo_reference", Drop: "cairo_destroy"}.
+	RefCounts map[string]RefCount
+	// OwnedStrings declares the functions returning strings owned by the
+	// callers (wildcards allowed), valued by the functions freeing them, e.g.
+	// "SDL_GetClipboardText": "SDL_free". The generated code copies and then
+	// frees the strings. The others are borrowed, including const char*. A key
+	// matching no function returning a string is an error.
+	OwnedStrings map[string]string
+	// ErrorRule makes the functions returning status codes return Go errors.
+	ErrorRule *ErrorRule
+	// Variadics lists the instances of C variadic functions to wrap.
+	Variadics []Variadic
+	// PrintfFuncs lists the printf-like functions not marked by the format
+	// attribute.
+	PrintfFuncs []string
+	// Macros declares the function-like macros to wrap by their prototypes,
+	// e.g. "SDL_BUTTON": "Uint32 SDL_BUTTON(int X)".
+	Macros map[string]string
+	// ConstTypes sets the types of the constants converted from macros, keyed
+	// by regexp of the C names of the macros, valued by C type names, e.g.
+	// `\ASDL_INIT_`: "Uint32".
+	ConstTypes map[string]string
+	// InitializerPattern matches the initializer macros of structs, with the C
+	// name of the struct as the first submatch, `\A(\w+)_initializer\z` if
+	// empty. New<Struct> is generated for each of them.
+	InitializerPattern string
+	// TaggedUnions declares the unions selected by tags.
+	TaggedUnions []TaggedUnion
+	// FlexArrays declares the flexible array members keyed by
+	// "struct.member" C names, valued by the C name of the sibling field
+	// holding the length, or empty if there is none. T data[] and T data[0]
+	// are found without it, but the T data[1] idiom has to be declared.
+	FlexArrays map[string]string
 
 	// intermediate
 	Functions   []*Function
 	Callbacks   []CallbackFunc
 	TypeDeclMap TypeDeclMap
 	Variables   []*Variable
+	Constants   []*Constant
 
 	// Internal
 	pat        *regexp.Regexp
 	localNames map[string]string
-	fileIds    SSet
-	boolSet    SSet
+	argRules   argRules
+	// ArgRule matching arguments that are not pointers
+	argRuleErrs []string
+	// sorted CallbackRule
+	callbackRules []callbackRule
+	fileIds       SSet
+	// names of the header files of the package
+	headerFiles SSet
+	boolSet     SSet
+	xmlInfo     *xmlInfo
+	fileLines   map[string][]string
+	shims       []*shim
+	tempFile    string
+	macros      []*macro
+	// methods of TaggedUnions
+	taggedMethods []*taggedMethod
+	// New<Union>From<Field> of the union members
+	unionConstructors []*unionConstructor
+	// structs with function pointer fields set to Go functions
+	funcStructs []*funcStruct
+	// trampolines of the callbacks without user data
+	pools []*trampolinePool
+	// types owned by the callers of their constructors
+	owners []*owner
+	// sorted OwnedStrings
+	ownedStrings []ownedStringRule
+	// sorted PanicReturn
+	panicReturns []panicReturn
+	// callbacks retained until the release functions are called
+	retains []*retain
 	Statistics
 	*gcc.XmlDoc
 }
@@ -91,6 +184,21 @@ func (pac *Package) Load() (err error) {
 	pac.pat = regexp.MustCompile(pac.From.NamePattern)
 	pac.localNames = make(map[string]string)
 	pac.initBoolSet()
+	if err := pac.initArgRules(); err != nil {
+		return err
+	}
+	if err := pac.initCallbackRules(); err != nil {
+		return err
+	}
+	if err := pac.initPanicReturns(); err != nil {
+		return err
+	}
+	if err := pac.initOwnedStrings(); err != nil {
+		return err
+	}
+	if err := pac.initErrorRule(); err != nil {
+		return err
+	}
 	pac.TypeDeclMap = make(TypeDeclMap)
 	if err := pac.loadXmlDoc(); err != nil {
 		return err
@@ -100,6 +208,7 @@ func (pac *Package) Load() (err error) {
 	}
 	for _, inc := range pac.Included {
 		inc.XmlDoc = pac.XmlDoc
+		inc.xmlInfo = pac.xmlInfo
 		if err := inc.Load(); err != nil {
 			return err
 		}
@@ -107,6 +216,34 @@ func (pac *Package) Load() (err error) {
 	return nil
 }
 
+// reloadXmlDoc parses the headers again with the prototypes of the shims, the
+// rules initialized by Load are kept.
+func (pac *Package) reloadXmlDoc() error {
+	pac.XmlDoc = nil
+	if err := pac.loadXmlDoc(); err != nil {
+		return err
+	}
+	return pac.resetXmlDoc()
+}
+
+// resetXmlDoc clears the types and files found in the previous XmlDoc, of the
+// package and the included packages.
+func (pac *Package) resetXmlDoc() error {
+	pac.localNames = make(map[string]string)
+	pac.TypeDeclMap = make(TypeDeclMap)
+	if err := pac.initFileIds(); err != nil {
+		return err
+	}
+	for _, inc := range pac.Included {
+		inc.XmlDoc = pac.XmlDoc
+		inc.xmlInfo = pac.xmlInfo
+		if err := inc.resetXmlDoc(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (pac *Package) loadXmlDoc() error {
 	if pac.XmlDoc != nil {
 		return nil
@@ -122,6 +259,10 @@ func (pac *Package) loadXmlDoc() error {
 		inc.From.Write(f)
 	}
 	pac.From.Write(f)
+	for _, s := range pac.shims {
+		s.writeDecl(f)
+	}
+	pac.tempFile = f.Name()
 	f.Close()
 	xmlDocCfg := gcc.Xml{File: f.Name(), Args: pac.From.GccXmlArgs, CastXml: true}
 	xmlDoc, err := xmlDocCfg.Doc()
@@ -133,11 +274,13 @@ func (pac *Package) loadXmlDoc() error {
 	if err != nil {
 		return err
 	}
-	defer xmlFile.Close()
-	if err := xmlDocCfg.Save(xmlFile); err != nil {
+	err = xmlDocCfg.Save(xmlFile)
+	xmlFile.Close()
+	if err != nil {
 		return err
 	}
-	return nil
+	pac.xmlInfo, err = loadXmlInfo(xmlFile.Name())
+	return err
 }
 
 func (pac *Package) initBoolSet() {
@@ -149,11 +292,13 @@ func (pac *Package) initBoolSet() {
 
 func (pac *Package) initFileIds() error {
 	pac.fileIds = NewSSet()
+	pac.headerFiles = NewSSet()
 	fnames, err := gcc.IncludeFiles(pac.From.FullPath())
 	if err != nil {
 		return err
 	}
 	for _, name := range fnames {
+		pac.headerFiles.Add(path.Clean(name))
 		for _, file := range pac.XmlDoc.Files {
 			if file.CName() == name {
 				pac.fileIds.Add(file.Id())
@@ -161,6 +306,14 @@ func (pac *Package) initFileIds() error {
 			}
 		}
 	}
+	// the prototypes of shims are declared in the temporary header
+	if len(pac.shims) > 0 {
+		for _, file := range pac.XmlDoc.Files {
+			if path.Base(file.CName()) == path.Base(pac.tempFile) {
+				pac.fileIds.Add(file.Id())
+			}
+		}
+	}
 	return nil
 }
 
@@ -185,6 +338,13 @@ func (pac *Package) hFile() string {
 	return pac.defaultFile() + ".h"
 }
 
+func (pac *Package) testFile() string {
+	if pac.GoFile != "" {
+		return trimSuffix(pac.GoFile, ".go") + "_test.go"
+	}
+	return pac.defaultFile() + "_test.go"
+}
+
 func (pac *Package) defaultFile() string {
 	return path.Join(OutputDir, pac.PacPath, "/auto_"+runtime.GOARCH)
 }
@@ -215,43 +375,64 @@ func (pac *Package) Prepare() error {
 		if err := pac.Load(); err != nil {
 			return err
 		}
+		if err := pac.loadMacros(); err != nil {
+			return err
+		}
+		if err := pac.loadShims(); err != nil {
+			return err
+		}
 		if err := pac.prepareFunctions(); err != nil {
 			return err
 		}
+		if err := pac.checkArgRules(); err != nil {
+			return err
+		}
 		pac.prepareTypesAndNames()
+		if err := pac.checkErrorType(); err != nil {
+			return err
+		}
+		pac.prepareFuncStructs()
+		if err := pac.prepareOwners(); err != nil {
+			return err
+		}
+		if err := pac.prepareOwnedStrings(); err != nil {
+			return err
+		}
+		if err := pac.prepareFlexArrays(); err != nil {
+			return err
+		}
+		if err := pac.prepareLayouts(); err != nil {
+			return err
+		}
+		if err := pac.prepareConstants(); err != nil {
+			return err
+		}
+		if err := pac.prepareTaggedUnions(); err != nil {
+			return err
+		}
 	}
 	// reset localNames
 	pac.localNames = make(map[string]string)
 	return nil
 }
 
+// GenConst writes the constants converted from the macros to file.
+//
+// Deprecated: Wrap writes the constants into the Go file.
 func (pac *Package) GenConst(file string) error {
-	f, err := os.Create(file)
-	if err != nil {
+	if err := pac.Prepare(); err != nil {
 		return err
 	}
-	defer f.Close()
-	ms, err := gcc.Xml{File: pac.From.FullPath(), Args: pac.From.GccXmlArgs, CastXml: true}.Macros()
+	f, err := pac.createFile(file)
 	if err != nil {
 		return err
 	}
-	consts := ms.Constants(pac.From.NamePattern)
-	nm := make(map[string]string)
-	for _, c := range consts {
-		nm[c.Name] = upperName(c.Name, pac.pat)
-	}
-
+	defer f.Close()
 	fp(f, "package ", pac.PacName)
 	fp(f, "")
-	fp(f, "const (")
-	for _, c := range consts {
-		body := c.Body
-		for k, v := range nm {
-			body = replace(body, k, v)
-		}
-		fp(f, upperName(c.Name, pac.pat), "=", body)
+	for _, c := range pac.Constants {
+		pac.writeDecl(f, "const", c)
 	}
-	fp(f, ")")
 	return nil
 }
 
@@ -0,0 +1,43 @@
+// Copyright 2014, Hǎiliàng Wáng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cwrap
+
+import (
+	"io"
+)
+
+// addCallback adds an exported callback, or records the functions passing it
+// if it is added by another function taking the same callback type.
+func addCallback(callbacks []CallbackFunc, cb CallbackFunc) []CallbackFunc {
+	for i := range callbacks {
+		if callbacks[i].goName == cb.goName {
+			callbacks[i].uses = append(callbacks[i].uses, cb.uses...)
+			return callbacks
+		}
+	}
+	return append(callbacks, cb)
+}
+
+// writePanicHandler writes PanicHandler and the function reporting the panics
+// recovered by the exported callbacks.
+func (pac *Package) writePanicHandler(w io.Writer) {
+	if len(pac.Callbacks) == 0 {
+		return
+	}
+	fp(w, `// PanicHandler is called with the name of the callback and the recovered
+// value when a Go function called by C panics, instead of unwinding through C
+// frames. The callback then returns the value set by PanicReturn, zero by
+// default. The panic is logged with the stack if PanicHandler is nil.
+var PanicHandler func(callback string, v interface{})
+
+func handlePanic(callback string, v interface{}) {
+	if PanicHandler != nil {
+		PanicHandler(callback, v)
+		return
+	}
+	log.Print("panic in callback ", callback, ": ", v, "\n", string(debug.Stack()))
+}`)
+	fp(w)
+}
@@ -0,0 +1,68 @@
+// Copyright 2014, Hǎiliàng Wáng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cwrap
+
+import (
+	"strings"
+	"testing"
+)
+
+// sharedCallbacks returns the callback of type handler_t shared by f1.cb and
+// f2.cb.
+func sharedCallbacks() []CallbackFunc {
+	var callbacks []CallbackFunc
+	for _, use := range []string{"f1.cb", "f2.cb"} {
+		callbacks = addCallback(callbacks, CallbackFunc{
+			goName: "handlerTCallback_Go",
+			name:   "handler_t",
+			uses:   []string{use},
+		})
+	}
+	return callbacks
+}
+
+func TestSharedCallbackPanicReturn(t *testing.T) {
+	for _, tc := range []struct {
+		rules map[string]string
+		value string
+		err   string
+	}{
+		{rules: nil, value: ""},
+		{rules: map[string]string{"f2.cb": "1"}, value: "1"},
+		{rules: map[string]string{"f1.cb": "1"}, value: "1"},
+		{rules: map[string]string{"handler_t": "2"}, value: "2"},
+		{rules: map[string]string{"f*.cb": "3"}, value: "3"},
+		{rules: map[string]string{"f1.cb": "1", "f2.cb": "1"}, value: "1"},
+		{rules: map[string]string{"f1.cb": "1", "f2.cb": "2"}, err: "conflict"},
+		{rules: map[string]string{"f2.cb": "1", "f3.cb": "1"}, err: "PanicReturn f3.cb match no callbacks"},
+	} {
+		pac := &Package{PanicReturn: tc.rules}
+		if err := pac.initPanicReturns(); err != nil {
+			t.Fatal(err)
+		}
+		pac.Callbacks = sharedCallbacks()
+		if len(pac.Callbacks) != 1 {
+			t.Fatalf("expect 1 shared callback, got %d", len(pac.Callbacks))
+		}
+		err := pac.preparePanicReturns()
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%v: expect error %q, got %v", tc.rules, tc.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", tc.rules, err)
+			continue
+		}
+		cb := pac.Callbacks[0]
+		if cb.panicReturn != tc.value {
+			t.Errorf("%v: expect %q returned on panic, got %q", tc.rules, tc.value, cb.panicReturn)
+		}
+		if got := join(cb.uses, ", "); got != "f1.cb, f2.cb" {
+			t.Errorf("expect the callback used by f1.cb, f2.cb, got %s", got)
+		}
+	}
+}
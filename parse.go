@@ -147,9 +147,23 @@ func (pac *Package) getType(gt gcc.Type, ptrKind gcc.PtrKind) Type {
 }
 
 func (pac *Package) newFunction(fn *gcc.Function) *Function {
-	cArgs := pac.newArgs(fn.Arguments)
+	cName := fn.CName()
+	if s := pac.shimOf(cName); s != nil {
+		cName = s.cName
+	}
+	cArgs := pac.newArgs(cName, fn.Arguments)
 	goParams := cArgs.ToParams()
-	returns := pac.newReturn(fn.ReturnType())
+	for _, a := range cArgs {
+		if _, ok := a.type_.(*InOutPtr); ok {
+			goParams = append(goParams, &InOutResult{a})
+		}
+	}
+	var returns *Return
+	if pac.returnsError(cName, fn.ReturnType()) {
+		returns = pac.newErrorReturn(fn.ReturnType())
+	} else {
+		returns = pac.newReturn(fn.ReturnType())
+	}
 	if returns != nil {
 		goParams = append(goParams, returns)
 	}
@@ -161,27 +175,76 @@ func (pac *Package) newFunction(fn *gcc.Function) *Function {
 			Return:   returns,
 		},
 	}
-
+	if s := pac.shimOf(fn.CName()); s != nil {
+		f.cName = s.cName
+		f.shim = s
+		if s.printf {
+			f.convertToPrintf()
+		}
+	}
 	return f
 }
 
-func (pac *Package) newArgs(arguments gcc.Arguments) (args Arguments) {
+func (pac *Package) newArgs(fnName string, arguments gcc.Arguments) (args Arguments) {
 	for _, a := range arguments {
-		args = append(args, pac.newArg(a))
+		args = append(args, pac.newArg(fnName, a))
 	}
 	return args
 }
 
-func (pac *Package) newArg(a *gcc.Argument) *Argument {
+func (pac *Package) newArg(fnName string, a *gcc.Argument) *Argument {
 	goName := lowerName(a)
+	kind := pac.argKind(fnName, a.CName())
+	if _, ok := gcc.ToPointer(a.CType()); kind != argDefault && !ok {
+		if key := fnName + "." + a.CName(); !containsString(pac.argRuleErrs, key) {
+			pac.argRuleErrs = append(pac.argRuleErrs, key)
+		}
+		kind = argDefault
+	}
+	t, isOut := pac.getArgType(a, kind)
 	return &Argument{
 		baseParam{
 			goName,
 			"_" + goName,
-			pac.getType(a.CType(), a.PtrKind()),
+			t,
 		},
-		a.PtrKind() == gcc.PtrReturn,
+		isOut,
+	}
+}
+
+// getArgType returns the type of an argument and whether it is an output,
+// according to the kind forced by ArgRule or to the PtrKind guessed by
+// go-gccxml.
+func (pac *Package) getArgType(a *gcc.Argument, kind argKind) (Type, bool) {
+	pt, ok := gcc.ToPointer(a.CType())
+	if kind == argDefault || !ok {
+		// ArgRule on other arguments is reported by checkArgRules
+		return pac.getType(a.CType(), a.PtrKind()), a.PtrKind() == gcc.PtrReturn
+	}
+	pointedType := pt.PointedType()
+	switch kind {
+	case argOut:
+		return pac.getType(a.CType(), gcc.PtrReturn), true
+	case argInOut:
+		return pac.newInOutPtr(pointedType), false
+	case argString:
+		return pac.getType(a.CType(), gcc.PtrString), false
+	case argSlice:
+		return pac.getType(a.CType(), gcc.PtrArray), false
+	case argSliceSlice:
+		if gcc.IsCString(pointedType) {
+			return pac.getType(a.CType(), gcc.PtrStringArray), false
+		}
+		if _, ok := gcc.ToPointer(pointedType); ok {
+			return pac.getType(a.CType(), gcc.PtrArrayArray), false
+		}
+		return pac.getType(a.CType(), gcc.PtrArray), false
+	case argOpaque:
+		return &Ptr{&Void{}}, false
+	case argBuffer:
+		return newBufferArg(), true
 	}
+	return pac.newPtr(pointedType), false
 }
 
 func (pac *Package) newReturn(gt gcc.Type) *Return {
@@ -253,6 +316,10 @@ func (pac *Package) newReturnPtr(t gcc.Type) *ReturnPtr {
 	return &ReturnPtr{pac.declareEqualType(t)}
 }
 
+func (pac *Package) newInOutPtr(t gcc.Type) *InOutPtr {
+	return &InOutPtr{ReturnPtr{pac.declareEqualType(t)}}
+}
+
 func (pac *Package) newSliceSlice(elemType gcc.Type) *SliceSlice {
 	return newSliceSlice(pac.declareEqualType(elemType))
 }
@@ -274,9 +341,23 @@ func newStructWithoutFields(t *gcc.Struct) *Struct {
 }
 
 func (pac *Package) newStructFields(fields gcc.Fields) []StructField {
-	fs := make([]StructField, len(fields))
-	for i, f := range fields {
-		fs[i] = StructField{upperName(f.CName(), nil), pac.declareEqualType(f.CType())}
+	fs := make([]StructField, 0, len(fields))
+	for _, f := range fields {
+		bits := pac.xmlInfo.intAttr(f.Id(), "bits")
+		if bits == 0 {
+			// zero-width bitfield only affects the layout
+			continue
+		}
+		if bits < 0 {
+			bits = 0
+		}
+		fs = append(fs, StructField{
+			goName:    upperName(f.CName(), nil),
+			EqualType: pac.declareEqualType(f.CType()),
+			id:        f.Id(),
+			offset:    pac.xmlInfo.intAttr(f.Id(), "offset"),
+			bits:      bits,
+		})
 	}
 	return fs
 }
@@ -336,7 +417,17 @@ func newUnionWithoutFields(t *gcc.Union) *Union {
 func (pac *Package) newUnionFields(fields gcc.Fields, union *Union) []UnionField {
 	fs := make([]UnionField, len(fields))
 	for i, f := range fields {
-		fs[i] = UnionField{upperName(f.CName(), nil), pac.declareEqualType(f.CType()), union}
+		goName := upperName(f.CName(), nil)
+		if goName == "" {
+			// anonymous member
+			goName = sprint("Anon", i)
+		}
+		fs[i] = UnionField{
+			goName:    goName,
+			EqualType: pac.declareEqualType(f.CType()),
+			union:     union,
+			id:        f.Id(),
+		}
 	}
 	return fs
 }
@@ -381,7 +472,21 @@ func (pac *Package) TransformOriginalFunc(
 	// CArgs
 	{
 		ca, da := fn.CArgs[info.ArgIndex], fn.CArgs[info.ArgIndex+1]
-		da.goName = "&" + ca.GoName()
+		argName := oriFunc.Arguments[info.ArgIndex].CName()
+		rule := pac.callbackRule(fn.CName(), argName)
+		keep := rule.kind == callbackKeep
+		if keep {
+			fn.GoParams = append(fn.GoParams, &handleResult{
+				name:    ca.GoName() + "Handle",
+				release: "releaseHandle(" + da.CgoName() + "_h)",
+			})
+		}
+		da.goName = ca.GoName()
+		if rule.kind == callbackRetain {
+			da.type_ = &handleArg{owner: pac.retainOwner(fn, oriFunc, argName, rule)}
+		} else {
+			da.type_ = &handleArg{keep: keep}
+		}
 		ca.goName = cgoName(trimSuffix(f.goName, "_Go") + "_C")
 		fn.CArgs[info.ArgIndex], fn.CArgs[info.ArgIndex+1] = ca, da
 		ca.isOut, da.isOut = false, false
@@ -393,11 +498,16 @@ func (pac *Package) TransformOriginalFunc(
 
 func (pac *Package) newCallbackFunc(info *gcc.CallbackInfo) CallbackFunc {
 	callbackName := snakeToLowerCamel(pac.UpperName(info.CName)) + "Callback"
-	cArgs := pac.newArgs(info.CType.Arguments)
+	cArgs := pac.newArgs("", info.CType.Arguments)
 	for i, a := range cArgs {
 		if r, ok := a.type_.(*ReturnPtr); ok {
 			cArgs[i].type_ = &CallbackReturnPtr{r}
 		}
+		// the arguments of function types are not named
+		if a.goName == "" {
+			a.goName = sprint("a", i)
+			a.cgoName = "_" + a.goName
+		}
 	}
 	returns := pac.newReturn(info.CType.ReturnType())
 	goParams := cArgs.ToParams()
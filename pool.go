@@ -0,0 +1,202 @@
+// Copyright 2014, Hǎiliàng Wáng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cwrap
+
+import (
+	"io"
+
+	gcc "h12.io/go-gccxml"
+)
+
+const defaultCallbackPoolSize = 8
+
+// trampolinePool is a fixed number of C functions calling the exported Go
+// callback with their slot indexes, so that a callback without user data can
+// still be told apart by the slot of the Go function.
+type trampolinePool struct {
+	name   string // function.argument
+	goName string // Go variable holding the Go functions
+	cName  string // C array of the trampolines
+	size   int
+	ft     *gcc.FunctionType
+	export string // Go name of the exported callback
+}
+
+func (pac *Package) callbackPoolSize() int {
+	if pac.CallbackPoolSize > 0 {
+		return pac.CallbackPoolSize
+	}
+	return defaultCallbackPoolSize
+}
+
+// poolParams returns the indexes of the callback arguments of a function that
+// cannot pass user data, or nil if the function takes callbacks with user data
+// as well.
+func (pac *Package) poolParams(fn *gcc.Function) []int {
+	hasData := false
+	for _, a := range fn.Arguments {
+		if isVoidPtr(a.CType()) {
+			hasData = true
+		}
+	}
+	var ps []int
+	for i, a := range fn.Arguments {
+		ft := funcPtrOf(a.CType())
+		if ft == nil {
+			continue
+		}
+		if hasData && userDataArg(ft) >= 0 || a.CName() == "" {
+			return nil
+		}
+		ps = append(ps, i)
+	}
+	return ps
+}
+
+// transformPoolCallbacks returns the function taking Go functions in place of
+// the callbacks without user data, and the callbacks exported for it. A Go
+// function takes a slot of the pool of the callback, which is released when
+// the function returns, or by the returned CallbackHandle if it is kept by
+// CallbackRule.
+func (pac *Package) transformPoolCallbacks(oriFunc *gcc.Function, ps []int) (*Function, []CallbackFunc) {
+	fn := pac.newFunction(oriFunc)
+	var callbacks []CallbackFunc
+	for _, i := range ps {
+		a := oriFunc.Arguments[i]
+		cName := fn.CName() + "_" + a.CName()
+		cb := pac.newCallbackFunc(&gcc.CallbackInfo{
+			ArgIndex:  i,
+			DataIndex: -1,
+			CName:     cName,
+			CType:     funcPtrOf(a.CType()),
+		})
+		pool := &trampolinePool{
+			name:   fn.CName() + "." + a.CName(),
+			goName: snakeToLowerCamel(pac.UpperName(cName)) + "Pool",
+			cName:  shimPrefix + cName + "_pool",
+			size:   pac.callbackPoolSize(),
+			ft:     cb.CType,
+		}
+		cb.pool = pool
+		cb.name = pool.name
+		pool.export = cb.goName
+		pac.pools = append(pac.pools, pool)
+		callbacks = append(callbacks, cb)
+
+		ca := fn.CArgs[i]
+		fn.GoParams[i] = &Argument{baseParam{ca.goName, ca.cgoName, cb.internalFunc()}, false}
+		rule := pac.callbackRule(fn.CName(), a.CName())
+		keep := rule.kind == callbackKeep
+		pf := &poolFunc{pool: pool, keep: keep}
+		if rule.kind == callbackRetain {
+			pf.owner = pac.retainOwner(fn, oriFunc, a.CName(), rule)
+		}
+		ca.type_ = pf
+		ca.isOut = false
+		if keep {
+			fn.GoParams = append(fn.GoParams, &handleResult{
+				name:    ca.goName + "Handle",
+				release: pool.goName + ".release(" + ca.cgoName + "_slot)",
+			})
+		}
+	}
+	return fn, callbacks
+}
+
+// writeDecl writes the C declaration of the trampolines.
+func (p *trampolinePool) writeDecl(w io.Writer, pac *Package) {
+	fp(w, "extern ", pac.cDecl(p.ft, sprint("(*", p.cName, "[", p.size, "])")), ";")
+}
+
+// writeDef writes the C trampolines calling the exported Go callback with
+// their slots.
+func (p *trampolinePool) writeDef(w io.Writer, pac *Package) {
+	params, args := pac.cParams(p.ft.Arguments)
+	if len(params) == 0 {
+		params = []string{"void"}
+	}
+	args = append([]string{""}, args...)
+	for i := 0; i < p.size; i++ {
+		args[0] = sprint(i)
+		fp(w, "static ", pac.cDecl(p.ft.ReturnType(), sprint(p.cName, i, "(", join(params, ", "), ")")), " {")
+		fp(w, "\t", cReturn(p.ft.ReturnType(), p.export+"("+join(args, ", ")+")"))
+		fp(w, "}")
+		fp(w)
+	}
+	fp(w, pac.cDecl(p.ft, sprint("(*", p.cName, "[", p.size, "])")), " = {")
+	for i := 0; i < p.size; i++ {
+		fp(w, "\t", p.cName, i, ",")
+	}
+	fp(w, "};")
+}
+
+// writePools writes the Go functions held by the slots of the trampolines.
+func (pac *Package) writePools(w io.Writer) {
+	if len(pac.pools) == 0 {
+		return
+	}
+	fp(w, `
+// callbackPool holds the Go functions called by a pool of C trampolines of a
+// callback without user data.
+type callbackPool struct {
+	sync.Mutex
+	name  string
+	funcs []interface{}
+}
+
+// acquire puts f into a free slot and returns the slot, and panics if all the
+// slots are in use.
+func (p *callbackPool) acquire(f interface{}) int {
+	p.Lock()
+	defer p.Unlock()
+	for i, v := range p.funcs {
+		if v == nil {
+			p.funcs[i] = f
+			return i
+		}
+	}
+	panic("all the " + strconv.Itoa(len(p.funcs)) + " C trampolines of " + p.name +
+		" are in use, release some of them or generate more by CallbackPoolSize")
+}
+
+func (p *callbackPool) release(slot int) {
+	p.Lock()
+	p.funcs[slot] = nil
+	p.Unlock()
+}
+
+func (p *callbackPool) get(slot int) interface{} {
+	p.Lock()
+	defer p.Unlock()
+	return p.funcs[slot]
+}`)
+	fp(w)
+	for _, p := range pac.pools {
+		fp(w, "var ", p.goName, " = &callbackPool{name: \"", p.name, "\", funcs: make([]interface{}, ", p.size, ")}")
+	}
+	fp(w)
+}
+
+// poolFunc is a callback argument converted from a Go function by taking a
+// slot of the pool.
+type poolFunc struct {
+	baseType
+	pool  *trampolinePool
+	keep  bool
+	owner string // cgo name of the C object retaining the slot
+}
+
+func (t *poolFunc) ToCgo(w io.Writer, assign, g, c string) {
+	fp(w, c, "_slot := ", t.pool.goName, ".acquire(", g, ")")
+	if t.owner != "" {
+		fp(w, "retain(", t.owner, ", func() { ", t.pool.goName, ".release(", c, "_slot) })")
+	} else if !t.keep {
+		fp(w, "defer ", t.pool.goName, ".release(", c, "_slot)")
+	}
+	fp(w, c, assign, "=(*[0]byte)(C.", t.pool.cName, "[", c, "_slot])")
+}
+
+func (t *poolFunc) ToGo(w io.Writer, assign, g, c string) {
+}
@@ -0,0 +1,147 @@
+// Copyright 2014, Hǎiliàng Wáng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cwrap
+
+import (
+	"io"
+	"regexp"
+	"strconv"
+
+	gcc "h12.io/go-gccxml"
+)
+
+var (
+	// __attribute__((format(printf, 1, 2)))
+	printfAttrPat = regexp.MustCompile(`format\s*\(\s*_*printf_*\s*,\s*(\d+)`)
+	// attribute macros like G_GNUC_PRINTF(1, 2) or SDL_PRINTF_VARARG_FUNC(1)
+	printfMacroPat = regexp.MustCompile(`[A-Z_]*PRINTF[A-Z_]*\s*\(\s*(\d+)`)
+)
+
+// printfFormat returns the index of the format argument if the variadic
+// function is printf-like, either detected from its format attribute or
+// configured in Package.PrintfFuncs.
+func (pac *Package) printfFormat(fn *gcc.Function) (int, bool) {
+	attrs := pac.xmlInfo.attr(fn.Id(), "attributes") + " " + pac.declText(fn.Id())
+	for _, pat := range []*regexp.Regexp{printfAttrPat, printfMacroPat} {
+		if m := pat.FindStringSubmatch(attrs); m != nil {
+			i, _ := strconv.Atoi(m[1])
+			if i > 0 && i <= len(fn.Arguments) {
+				return i - 1, true
+			}
+		}
+	}
+	if !containsString(pac.PrintfFuncs, fn.CName()) {
+		return 0, false
+	}
+	// the last string argument
+	for i := len(fn.Arguments) - 1; i >= 0; i-- {
+		if gcc.IsCString(fn.Arguments[i].CType()) {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// declText returns the text of a declaration in the header, including the
+// leading part of it in the previous line.
+func (pac *Package) declText(id string) string {
+	line := pac.xmlInfo.intAttr(id, "line")
+	lines := pac.headerLines(pac.xmlInfo.attr(id, "file"))
+	if line <= 0 || line > len(lines) {
+		return ""
+	}
+	start := line - 1
+	if start > 0 && isDeclPart(lines[start-1]) {
+		start--
+	}
+	text := ""
+	for i := start; i < len(lines) && i < line+5; i++ {
+		text += lines[i] + "\n"
+		if contains(lines[i], ";") {
+			break
+		}
+	}
+	return text
+}
+
+// newPrintfShim returns the shim of a printf-like function that prints its
+// format argument as is, so that it is formatted by fmt.Sprintf in Go.
+func (pac *Package) newPrintfShim(fn *gcc.Function, format int) *shim {
+	params, args := pac.cParams(fn.Arguments)
+	args = append(args, args[format])
+	args[format] = `"%s"`
+	name := shimPrefix + fn.CName()
+	return &shim{
+		name:   name,
+		cName:  fn.CName(),
+		src:    fn.CName(),
+		proto:  pac.cDecl(fn.ReturnType(), name+"("+join(params, ", ")+")"),
+		body:   cReturn(fn.ReturnType(), fn.CName()+"("+join(args, ", ")+")"),
+		printf: true,
+		format: format,
+	}
+}
+
+// convertToPrintf makes the Go function take a format and variadic arguments
+// like fmt.Printf.
+func (f *Function) convertToPrintf() {
+	a := f.CArgs[f.shim.format]
+	if a.goName == "fmt" {
+		a.goName = "format"
+	}
+	args := &VariadicParam{"args"}
+	a.type_ = &FormatString{newString(), args.GoName()}
+	var ps Params
+	for _, p := range f.GoParams {
+		if !p.IsOut() {
+			ps = append(ps, p)
+		}
+	}
+	ps = append(ps, args)
+	f.GoParams = append(ps, f.GoParams.Out()...)
+}
+
+// FormatString is the format argument of a printf-like function, formatted
+// in Go before passed to C.
+type FormatString struct {
+	*String
+	args string
+}
+
+func (s *FormatString) ToCgo(w io.Writer, assign, g, c string) {
+	fp(w, g, "=fmt.Sprintf(", g, ",", s.args, "...)")
+	s.String.ToCgo(w, assign, g, c)
+}
+
+// VariadicParam is the variadic arguments of a printf-like function.
+type VariadicParam struct {
+	goName string
+}
+
+func (p *VariadicParam) GoName() string {
+	return p.goName
+}
+
+func (p *VariadicParam) CgoName() string {
+	return ""
+}
+
+func (p *VariadicParam) GoTypeName() string {
+	return "...interface{}"
+}
+
+func (p *VariadicParam) CgoTypeName() string {
+	return ""
+}
+
+func (p *VariadicParam) ToCgo(w io.Writer, assign string) {
+}
+
+func (p *VariadicParam) ToGo(w io.Writer, assign string) {
+}
+
+func (p *VariadicParam) IsOut() bool {
+	return false
+}
@@ -0,0 +1,273 @@
+// Copyright 2014, Hǎiliàng Wáng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cwrap
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"path"
+
+	gcc "h12.io/go-gccxml"
+)
+
+// RefCount declares the functions counting the references to a C type.
+type RefCount struct {
+	Keep string // takes a reference, e.g. cairo_reference, fz_keep_pixmap
+	Drop string // releases a reference, e.g. cairo_destroy, fz_drop_pixmap
+	// Owned lists the functions returning new references besides the
+	// constructors named with new, create or open (wildcards allowed, e.g.
+	// "fz_load_*"). The references returned by the other functions are
+	// borrowed, so the generated code takes them.
+	Owned []string
+}
+
+// refCount is a reference counted type declared by RefCounts.
+type refCount struct {
+	*RefCount
+	keep, drop *refFunc
+}
+
+// refFunc is the keep or drop function of a reference counted type, or the
+// free function of owned strings, called with the object and the other
+// arguments pointing to declared types, e.g. the context of fz_keep_pixmap.
+type refFunc struct {
+	cName string
+	args  []refArg
+}
+
+type refArg struct {
+	name    string // Go name, empty for the object
+	goType  string
+	cgoType string // empty if the argument is void*
+}
+
+// newRefFunc returns the keep or drop function of the type declared by d, or
+// the free function of the C type if d is nil. rule names the rule in errors.
+func (pac *Package) newRefFunc(rule, cType string, d TypeDecl, cName string) (*refFunc, error) {
+	var fn *gcc.Function
+	for _, f := range pac.XmlDoc.Functions {
+		if f.CName() == cName {
+			fn = f
+		}
+	}
+	if fn == nil {
+		return nil, fmt.Errorf("%s %s: %s is not found", rule, cType, cName)
+	}
+	rf := &refFunc{cName: cName}
+	hasObject := false
+	for i, a := range fn.Arguments {
+		t := pointedType(a.CType())
+		switch {
+		case !hasObject && isVoidPtr(unalias(a.CType())):
+			// typedefs of void*, e.g. gpointer, are distinct types in cgo
+			cgoType := ""
+			if name := cNameOf(a.CType()); name != "" && !isVoidPtr(a.CType()) {
+				cgoType = "C." + name
+			}
+			rf.args = append(rf.args, refArg{cgoType: cgoType})
+			hasObject = true
+		case !hasObject && t != nil && d != nil && (t.Id() == d.Id() || cNameOf(t) == cType):
+			rf.args = append(rf.args, refArg{cgoType: "*" + d.CgoName()})
+			hasObject = true
+		case !hasObject && t != nil && d == nil && cNameOf(unalias(t)) == "char":
+			rf.args = append(rf.args, refArg{cgoType: "*C.char"})
+			hasObject = true
+		default:
+			var ad TypeDecl
+			if t != nil {
+				ad = pac.TypeDeclMap[t.Id()]
+			}
+			if ad == nil || ad.GoName() == "" || contains(ad.GoName(), ".") {
+				return nil, fmt.Errorf("%s %s: argument %d of %s is not a pointer to a declared type",
+					rule, cType, i, cName)
+			}
+			name := snakeToLowerCamel(a.CName())
+			if name == "" {
+				name = sprint("a", i)
+			}
+			rf.args = append(rf.args, refArg{name: name, goType: "*" + ad.GoName(), cgoType: "*" + ad.CgoName()})
+		}
+	}
+	if !hasObject {
+		return nil, fmt.Errorf("%s %s: %s does not take %s", rule, cType, cName, cType)
+	}
+	return rf, nil
+}
+
+// params returns the Go parameters of the arguments other than the object.
+func (rf *refFunc) params() string {
+	var ps []string
+	for _, a := range rf.args {
+		if a.name != "" {
+			ps = append(ps, a.name+" "+a.goType)
+		}
+	}
+	return join(ps, ", ")
+}
+
+// call returns the Go expression calling the C function with the object and
+// the other arguments returned by arg.
+func (rf *refFunc) call(object string, arg func(a refArg) string) string {
+	var args []string
+	for _, a := range rf.args {
+		v := object
+		if a.name != "" {
+			v = arg(a)
+		}
+		if a.cgoType == "" {
+			args = append(args, "unsafe.Pointer("+v+")")
+		} else {
+			args = append(args, "("+a.cgoType+")(unsafe.Pointer("+v+"))")
+		}
+	}
+	return "C." + rf.cName + "(" + join(args, ", ") + ")"
+}
+
+func (rf *refFunc) hasParams() bool {
+	return rf.params() != ""
+}
+
+// prepareRefCounts adds the owners of the reference counted types, which take
+// the references returned by the functions other than the constructors. It is
+// called by prepareOwners with the functions by their C names.
+func (pac *Package) prepareRefCounts(funcs map[string]*Function, cNames []string) error {
+	for _, cType := range sortedRefCounts(pac.RefCounts) {
+		rc := pac.RefCounts[cType]
+		var decl TypeDecl
+		pac.TypeDeclMap.Each(func(d TypeDecl) {
+			if d.CName() == cType && d.GoName() != "" && !contains(d.GoName(), ".") {
+				decl = d
+			}
+		})
+		if decl == nil {
+			return fmt.Errorf("RefCounts %s is not found", cType)
+		}
+		for _, p := range rc.Owned {
+			if _, err := path.Match(p, ""); err != nil {
+				return Wrapf(err, "invalid RefCounts %s: Owned %q", cType, p)
+			}
+		}
+		ref := &refCount{RefCount: &rc}
+		var err error
+		if ref.keep, err = pac.newRefFunc("RefCounts", cType, decl, rc.Keep); err != nil {
+			return err
+		}
+		if ref.drop, err = pac.newRefFunc("RefCounts", cType, decl, rc.Drop); err != nil {
+			return err
+		}
+		o := &owner{cType: cType, decl: decl, ref: ref}
+		for _, cName := range cNames {
+			f := funcs[cName]
+			if cName == rc.Keep || cName == rc.Drop || !returns(f, decl) {
+				continue
+			}
+			if constructorPat.MatchString(cName) || ref.owns(cName) {
+				o.constructors = append(o.constructors, f)
+				continue
+			}
+			if k := pac.borrowedKeep(f, ref.keep); k != nil {
+				f.keep = k
+				f.doc = joinDoc(f.doc, sprint("It takes a reference to the returned ", decl.GoName(),
+					", which must be released by Close."))
+			} else {
+				log.Print("skip taking the reference returned by ", cName, ": no argument for ", rc.Keep)
+			}
+		}
+		pac.owners = append(pac.owners, o)
+	}
+	return nil
+}
+
+func sortedRefCounts(m map[string]RefCount) []string {
+	keys := make(map[string]string)
+	for k := range m {
+		keys[k] = ""
+	}
+	return sortedKeys(keys)
+}
+
+func (r *refCount) owns(cName string) bool {
+	for _, p := range r.Owned {
+		if ok, _ := path.Match(p, cName); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// borrowedKeep returns the call taking the reference returned by f, or nil if
+// the other arguments of keep are not passed to f.
+func (pac *Package) borrowedKeep(f *Function, keep *refFunc) *refKeep {
+	args := keep.argsOf(f)
+	if args == nil {
+		return nil
+	}
+	return &refKeep{keep: keep, args: args}
+}
+
+// argsOf returns the cgo names of the arguments of f passed as the other
+// arguments of rf by their types, or nil if there are not.
+func (rf *refFunc) argsOf(f *Function) map[string]string {
+	args := make(map[string]string)
+	for _, a := range rf.args {
+		if a.name == "" {
+			continue
+		}
+		for _, ca := range f.CArgs {
+			if ca.GoTypeName() == a.goType {
+				args[a.name] = ca.CgoName()
+				break
+			}
+		}
+		if args[a.name] == "" {
+			return nil
+		}
+	}
+	return args
+}
+
+// refKeep takes the reference returned by a function.
+type refKeep struct {
+	keep *refFunc
+	args map[string]string // cgo names of the arguments of the function
+}
+
+func (k *refKeep) write(w io.Writer, f *Function) {
+	ret := f.Return.CgoName()
+	fp(w, "if ", ret, " != nil {")
+	fp(w, k.keep.call(ret, func(a refArg) string { return k.args[a.name] }))
+	fp(w, "}")
+}
+
+// writeRefCount writes Close releasing a reference and Clone taking one.
+func (o *owner) writeRefCount(w io.Writer) {
+	name, ref := o.decl.GoName(), o.ref
+	self := func(a refArg) string { return a.name }
+	if !methodsOf(o.decl).Has("Close") {
+		writeComment(w, sprint("Close releases the reference to the ", name, " by ", ref.drop.cName, "."))
+		fp(w, "func (p *", name, ") Close(", ref.drop.params(), ") {")
+		fp(w, ref.drop.call("p", self))
+		fp(w, "}")
+		fp(w)
+	}
+	if !methodsOf(o.decl).Has("Clone") {
+		writeComment(w, sprint("Clone takes a reference to the ", name, " by ", ref.keep.cName,
+			", which must be\nreleased by Close as well."))
+		fp(w, "func (p *", name, ") Clone(", ref.keep.params(), ") *", name, " {")
+		fp(w, ref.keep.call("p", self))
+		fp(w, "return p")
+		fp(w, "}")
+		fp(w)
+	}
+}
+
+// cNameOf returns the C name of a named type, or empty if it is not named.
+func cNameOf(t gcc.Type) string {
+	if n, ok := t.(gcc.Named); ok {
+		return n.CName()
+	}
+	return ""
+}
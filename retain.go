@@ -0,0 +1,141 @@
+// Copyright 2014, Hǎiliàng Wáng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cwrap
+
+import (
+	"fmt"
+	"io"
+
+	gcc "h12.io/go-gccxml"
+)
+
+// retain is a callback argument retained by CallbackRule until the release
+// function is called with the C object passed as the first argument.
+type retain struct {
+	name    string // function.argument
+	release string // C name of the release function
+	owner   gcc.Type
+}
+
+// retainOwner records that the callback argument of fn is retained by r, and
+// returns the cgo name of the first argument of fn, the C object retaining the
+// Go function.
+func (pac *Package) retainOwner(fn *Function, oriFunc *gcc.Function, argName string, r callbackRule) string {
+	rt := &retain{name: fn.CName() + "." + argName, release: r.release}
+	pac.retains = append(pac.retains, rt)
+	if len(oriFunc.Arguments) == 0 {
+		return ""
+	}
+	t := oriFunc.Arguments[0].CType()
+	if funcPtrOf(t) != nil || isVoidPtr(t) {
+		return ""
+	}
+	rt.owner = unqualified(t)
+	return fn.CArgs[0].CgoName()
+}
+
+// prepareRetained finds the release functions of the retained callbacks,
+// whose first arguments are the C objects retaining them, or pointers to
+// them, e.g. MQTTAsync_destroy(MQTTAsync *handle).
+func (pac *Package) prepareRetained(functions []*Function) error {
+	for _, rt := range pac.retains {
+		if rt.owner == nil {
+			return fmt.Errorf("CallbackRule %s: no C object as the first argument to retain the callback", rt.name)
+		}
+		var fn *gcc.Function
+		for _, f := range pac.XmlDoc.Functions {
+			if f.CName() == rt.release {
+				fn = f
+			}
+		}
+		if fn == nil {
+			return fmt.Errorf("CallbackRule %s: release function %s is not found", rt.name, rt.release)
+		}
+		deref := false
+		if len(fn.Arguments) > 0 {
+			t := unqualified(fn.Arguments[0].CType())
+			if pt, ok := t.(*gcc.PointerType); ok && t.Id() != rt.owner.Id() {
+				t, deref = unqualified(pt.PointedType()), true
+			}
+			if t.Id() != rt.owner.Id() {
+				fn = nil
+			}
+		}
+		if fn == nil || len(fn.Arguments) == 0 {
+			return fmt.Errorf("CallbackRule %s: the first argument of %s is not the C object retaining the callback",
+				rt.name, rt.release)
+		}
+		released := false
+		for _, f := range functions {
+			if f.CName() == rt.release && len(f.CArgs) > 0 {
+				f.release = &retainRelease{deref: deref}
+				released = true
+			}
+		}
+		if !released {
+			return fmt.Errorf("CallbackRule %s: release function %s is not generated", rt.name, rt.release)
+		}
+	}
+	return nil
+}
+
+// retainRelease releases the Go functions retained by the C object passed to
+// a release function after it is called.
+type retainRelease struct {
+	deref bool // the first argument points to the C object
+}
+
+func (r *retainRelease) before(w io.Writer, f *Function) {
+	owner := f.CArgs[0].CgoName()
+	if r.deref {
+		owner = "*" + owner
+	}
+	fp(w, f.CArgs[0].CgoName(), "_owner := ", owner)
+}
+
+func (r *retainRelease) after(w io.Writer, f *Function) {
+	fp(w, "releaseRetained(", f.CArgs[0].CgoName(), "_owner)")
+}
+
+// writeRetained writes the registry of the Go functions retained by C objects.
+func (pac *Package) writeRetained(w io.Writer) {
+	if len(pac.retains) == 0 {
+		return
+	}
+	fp(w, `// retained keeps the Go functions passed to C until the C objects retaining
+// them are released.
+var retained = struct {
+	sync.Mutex
+	m map[interface{}][]func()
+}{m: make(map[interface{}][]func())}
+
+func retain(owner interface{}, release func()) {
+	retained.Lock()
+	retained.m[owner] = append(retained.m[owner], release)
+	retained.Unlock()
+}
+
+func releaseRetained(owner interface{}) {
+	retained.Lock()
+	releases := retained.m[owner]
+	delete(retained.m, owner)
+	retained.Unlock()
+	for _, release := range releases {
+		release()
+	}
+}`)
+	fp(w)
+}
+
+// unqualified returns t without const or volatile qualifiers.
+func unqualified(t gcc.Type) gcc.Type {
+	for {
+		c, ok := t.(*gcc.CvQualifiedType)
+		if !ok {
+			return t
+		}
+		t = c.Base()
+	}
+}
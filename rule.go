@@ -0,0 +1,314 @@
+// Copyright 2014, Hǎiliàng Wáng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cwrap
+
+import (
+	"fmt"
+	"path"
+	"sort"
+)
+
+// argKind forces how a C pointer argument is mapped to Go, overriding the
+// guess of go-gccxml.
+type argKind int
+
+const (
+	argDefault    argKind = iota
+	argIn                 // *T input parameter
+	argOut                // T result
+	argInOut              // T input parameter and T result
+	argString             // string input parameter
+	argSlice              // []T input parameter
+	argSliceSlice         // [][]T (or []string) input parameter
+	argOpaque             // uintptr input parameter
+	argBuffer             // string result filled in a buffer
+)
+
+const bufferPrefix = "buffer:"
+
+var argKinds = map[string]argKind{
+	"in":         argIn,
+	"out":        argOut,
+	"inout":      argInOut,
+	"string":     argString,
+	"slice":      argSlice,
+	"sliceslice": argSliceSlice,
+	"opaque":     argOpaque,
+	"buffer":     argBuffer,
+}
+
+type argRule struct {
+	pattern string
+	kind    argKind
+	size    string // of argBuffer: length argument, constant or "query"
+	used    bool   // matched by an argument
+}
+
+// argRules is sorted so that the most specific (longest) pattern is matched
+// first.
+type argRules []argRule
+
+func (rs argRules) Len() int {
+	return len(rs)
+}
+
+func (rs argRules) Less(i, j int) bool {
+	return morePrecise(rs[i].pattern, rs[j].pattern)
+}
+
+func (rs argRules) Swap(i, j int) {
+	rs[i], rs[j] = rs[j], rs[i]
+}
+
+// initArgRules parses Package.ArgRule. A key is "function.argument", and
+// either part may contain wildcards as in path.Match, e.g. "nc_inq_*.name".
+func (pac *Package) initArgRules() error {
+	pac.argRules = nil
+	for key, value := range pac.ArgRule {
+		kind, ok := argKinds[value]
+		size := ""
+		if hasPrefix(value, bufferPrefix) {
+			kind, size = argBuffer, trimPrefix(value, bufferPrefix)
+			ok = size != ""
+		}
+		if !ok {
+			return fmt.Errorf("invalid ArgRule %q: unknown kind %q", key, value)
+		}
+		if _, err := path.Match(key, ""); err != nil {
+			return Wrapf(err, "invalid ArgRule %q", key)
+		}
+		pac.argRules = append(pac.argRules, argRule{pattern: key, kind: kind, size: size})
+	}
+	sort.Sort(pac.argRules)
+	return nil
+}
+
+// morePrecise returns true if pattern a is matched before pattern b.
+func morePrecise(a, b string) bool {
+	if len(a) != len(b) {
+		return len(a) > len(b)
+	}
+	return a < b
+}
+
+// argKind returns the kind forced by ArgRule for the argument of a function.
+func (pac *Package) argKind(fnName, argName string) argKind {
+	return pac.argRule(fnName, argName).kind
+}
+
+// argRule returns the rule of ArgRule for the argument of a function, and
+// marks it used.
+func (pac *Package) argRule(fnName, argName string) argRule {
+	if fnName == "" || argName == "" {
+		return argRule{kind: argDefault}
+	}
+	key := fnName + "." + argName
+	i := -1
+	if _, ok := pac.ArgRule[key]; ok {
+		for j, r := range pac.argRules {
+			if r.pattern == key {
+				i = j
+				break
+			}
+		}
+	}
+	for j := 0; i < 0 && j < len(pac.argRules); j++ {
+		if ok, _ := path.Match(pac.argRules[j].pattern, key); ok {
+			i = j
+		}
+	}
+	if i < 0 {
+		return argRule{kind: argDefault}
+	}
+	pac.argRules[i].used = true
+	return pac.argRules[i]
+}
+
+// checkArgRules returns an error if any ArgRule matches an argument that is not
+// a pointer, or no argument of the generated functions, which must go after
+// prepareFunctions.
+func (pac *Package) checkArgRules() error {
+	if len(pac.argRuleErrs) > 0 {
+		sort.Strings(pac.argRuleErrs)
+		return fmt.Errorf("ArgRule %s: not a pointer argument", join(pac.argRuleErrs, ", "))
+	}
+	var unused []string
+	for _, r := range pac.argRules {
+		if !r.used {
+			unused = append(unused, r.pattern)
+		}
+	}
+	if len(unused) > 0 {
+		sort.Strings(unused)
+		return fmt.Errorf("ArgRule %s match no function arguments", join(unused, ", "))
+	}
+	return nil
+}
+
+// callbackKind is how long the Go function passed as a callback is kept for C.
+type callbackKind int
+
+const (
+	callbackCall   callbackKind = iota // until the function returns
+	callbackKeep                       // until the returned handle is released
+	callbackRetain                     // until the release function is called
+)
+
+const retainPrefix = "retain:"
+
+var callbackKinds = map[string]callbackKind{
+	"call": callbackCall,
+	"keep": callbackKeep,
+}
+
+type callbackRule struct {
+	pattern string
+	kind    callbackKind
+	release string // C name of the release function of callbackRetain
+}
+
+// initCallbackRules parses Package.CallbackRule, keyed like ArgRule.
+func (pac *Package) initCallbackRules() error {
+	pac.callbackRules = nil
+	for key, value := range pac.CallbackRule {
+		kind, ok := callbackKinds[value]
+		release := ""
+		if hasPrefix(value, retainPrefix) {
+			kind, release = callbackRetain, trimPrefix(value, retainPrefix)
+			ok = release != ""
+		}
+		if !ok {
+			return fmt.Errorf("invalid CallbackRule %q: unknown kind %q", key, value)
+		}
+		if _, err := path.Match(key, ""); err != nil {
+			return Wrapf(err, "invalid CallbackRule %q", key)
+		}
+		pac.callbackRules = append(pac.callbackRules, callbackRule{key, kind, release})
+	}
+	sort.Slice(pac.callbackRules, func(i, j int) bool {
+		return morePrecise(pac.callbackRules[i].pattern, pac.callbackRules[j].pattern)
+	})
+	return nil
+}
+
+// callbackRule returns the rule set by CallbackRule for the callback argument
+// of a function.
+func (pac *Package) callbackRule(fnName, argName string) callbackRule {
+	key := fnName + "." + argName
+	for _, r := range pac.callbackRules {
+		if ok, _ := path.Match(r.pattern, key); ok {
+			return r
+		}
+	}
+	return callbackRule{kind: callbackCall}
+}
+
+type panicReturn struct {
+	pattern string
+	value   string
+	used    bool // matched by a callback
+}
+
+// initPanicReturns parses Package.PanicReturn, keyed like ArgRule.
+func (pac *Package) initPanicReturns() error {
+	pac.panicReturns = nil
+	for key, value := range pac.PanicReturn {
+		if _, err := path.Match(key, ""); err != nil {
+			return Wrapf(err, "invalid PanicReturn %q", key)
+		}
+		pac.panicReturns = append(pac.panicReturns, panicReturn{pattern: key, value: value})
+	}
+	sort.Slice(pac.panicReturns, func(i, j int) bool {
+		return morePrecise(pac.panicReturns[i].pattern, pac.panicReturns[j].pattern)
+	})
+	return nil
+}
+
+// panicReturn returns the value set by PanicReturn for the callback, and marks
+// the matched rule used.
+func (pac *Package) panicReturn(name string) string {
+	for i, r := range pac.panicReturns {
+		if ok, _ := path.Match(r.pattern, name); ok {
+			pac.panicReturns[i].used = true
+			return r.value
+		}
+	}
+	return ""
+}
+
+// preparePanicReturns sets the values returned by the callbacks on panic, by
+// PanicReturn matching their names, or the function arguments passing a
+// shared callback, which must agree.
+func (pac *Package) preparePanicReturns() error {
+	for i := range pac.Callbacks {
+		cb := &pac.Callbacks[i]
+		cb.panicReturn = ""
+		key := ""
+		for _, name := range append([]string{cb.name}, cb.uses...) {
+			v := pac.panicReturn(name)
+			if v == "" {
+				continue
+			}
+			if cb.panicReturn != "" && v != cb.panicReturn {
+				return fmt.Errorf("PanicReturn %s and %s conflict for the callback %s shared by them",
+					key, name, cb.name)
+			}
+			cb.panicReturn, key = v, name
+		}
+	}
+	return pac.checkPanicReturns()
+}
+
+// checkPanicReturns returns an error if any PanicReturn matches no callback.
+func (pac *Package) checkPanicReturns() error {
+	var unused []string
+	for _, r := range pac.panicReturns {
+		if !r.used {
+			unused = append(unused, r.pattern)
+		}
+	}
+	if len(unused) > 0 {
+		sort.Strings(unused)
+		return fmt.Errorf("PanicReturn %s match no callbacks", join(unused, ", "))
+	}
+	return nil
+}
+
+type ownedStringRule struct {
+	pattern string
+	free    string
+	used    bool // matched by a function returning a string
+}
+
+// initOwnedStrings parses Package.OwnedStrings, keyed by function names with
+// wildcards as in path.Match.
+func (pac *Package) initOwnedStrings() error {
+	pac.ownedStrings = nil
+	for key, value := range pac.OwnedStrings {
+		if _, err := path.Match(key, ""); err != nil {
+			return Wrapf(err, "invalid OwnedStrings %q", key)
+		}
+		if value == "" {
+			return fmt.Errorf("invalid OwnedStrings %q: no free function", key)
+		}
+		pac.ownedStrings = append(pac.ownedStrings, ownedStringRule{pattern: key, free: value})
+	}
+	sort.Slice(pac.ownedStrings, func(i, j int) bool {
+		return morePrecise(pac.ownedStrings[i].pattern, pac.ownedStrings[j].pattern)
+	})
+	return nil
+}
+
+// stringFree returns the function freeing the string returned by a function,
+// or empty if the string is borrowed. The matched rule is marked used.
+func (pac *Package) stringFree(fnName string) string {
+	for i, r := range pac.ownedStrings {
+		if ok, _ := path.Match(r.pattern, fnName); ok {
+			pac.ownedStrings[i].used = true
+			return r.free
+		}
+	}
+	return ""
+}
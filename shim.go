@@ -0,0 +1,376 @@
+// Copyright 2014, Hǎiliàng Wáng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cwrap
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"regexp"
+	"strings"
+
+	gcc "h12.io/go-gccxml"
+)
+
+const (
+	shimPrefix = "cwrap_"
+
+	defaultInitializerPattern = `\A(\w+)_initializer\z`
+)
+
+// Variadic instantiates a C variadic function with fixed arguments.
+type Variadic struct {
+	// C name of the variadic function.
+	Func string
+	// Appended to the C name to name the instance, e.g. "int".
+	Suffix string
+	// C types of the arguments passed in place of "...", e.g. "int".
+	Args []string
+}
+
+func (v *Variadic) cName() string {
+	if v.Suffix == "" {
+		return v.Func
+	}
+	return v.Func + "_" + v.Suffix
+}
+
+// shim is a C function generated into the C file to expose what cgo cannot
+// call directly (variadic functions, macros or inline functions) as a normal
+// C function. Its prototype is parsed by castxml together with the headers, so
+// it is wrapped like other functions.
+type shim struct {
+	name  string // C name of the shim
+	cName string // C name used to name the wrapper
+	src   string // C name of the wrapped declaration
+	proto string // C prototype
+	body  string // C statements
+
+	// printf-like function with the index of the format argument
+	printf bool
+	format int
+
+	// returns the value of an initializer macro
+	initializer bool
+}
+
+func (s *shim) writeDecl(w io.Writer) {
+	fp(w, s.proto, ";")
+}
+
+func (s *shim) writeDef(w io.Writer) {
+	fp(w, s.proto, " {")
+	fp(w, "\t", s.body)
+	fp(w, "}")
+}
+
+func (pac *Package) shimOf(name string) *shim {
+	for _, s := range pac.shims {
+		if s.name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+// shimmed returns true if the C declaration is wrapped by a shim.
+func (pac *Package) shimmed(src string) bool {
+	for _, s := range pac.shims {
+		if s.src == src {
+			return true
+		}
+	}
+	return false
+}
+
+// replaced returns true if the C function is wrapped by a shim of the same
+// name instead.
+func (pac *Package) replaced(cName string) bool {
+	for _, s := range pac.shims {
+		if s.src == cName && s.cName == cName {
+			return true
+		}
+	}
+	return false
+}
+
+func hasShim(shims []*shim, name string) bool {
+	for _, s := range shims {
+		if s.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// loadShims collects the shims needed by the parsed header and parses the
+// header again together with the prototypes of the shims.
+func (pac *Package) loadShims() error {
+	shims, err := pac.collectShims()
+	if err != nil {
+		return err
+	}
+	if len(shims) == 0 {
+		return nil
+	}
+	pac.shims = shims
+	return pac.reloadXmlDoc()
+}
+
+func (pac *Package) collectShims() ([]*shim, error) {
+	var shims []*shim
+	fns := make(map[string]*gcc.Function)
+	for _, fn := range pac.XmlDoc.Functions {
+		fns[fn.CName()] = fn
+	}
+	for i := range pac.Variadics {
+		v := &pac.Variadics[i]
+		fn, ok := fns[v.Func]
+		if !ok || len(fn.Ellipses) == 0 {
+			return nil, fmt.Errorf("Variadic: %s is not a variadic function", v.Func)
+		}
+		shims = append(shims, pac.newVariadicShim(fn, v))
+	}
+	inits, err := pac.initializerShims()
+	if err != nil {
+		return nil, err
+	}
+	shims = append(shims, inits...)
+	shims = append(shims, pac.funcFieldShims()...)
+	for _, name := range sortedKeys(pac.Macros) {
+		s, err := newMacroShim(name, pac.Macros[name])
+		if err != nil {
+			return nil, err
+		}
+		shims = append(shims, s)
+	}
+	for _, fn := range pac.XmlDoc.Functions {
+		if !pac.exported(fn.CName(), fn.File()) {
+			continue
+		}
+		if pac.xmlInfo.attr(fn.Id(), "inline") == "1" && len(fn.Ellipses) == 0 {
+			shims = append(shims, pac.newInlineShim(fn))
+			continue
+		}
+		if len(fn.Ellipses) == 0 {
+			continue
+		}
+		if format, ok := pac.printfFormat(fn); ok {
+			s := pac.newPrintfShim(fn, format)
+			if !hasShim(shims, s.name) {
+				shims = append(shims, s)
+			}
+		}
+	}
+	return shims, nil
+}
+
+func (pac *Package) newVariadicShim(fn *gcc.Function, v *Variadic) *shim {
+	params, args := pac.cParams(fn.Arguments)
+	for i, t := range v.Args {
+		name := sprint("v", i)
+		params = append(params, t+" "+name)
+		args = append(args, name)
+	}
+	name := shimPrefix + v.cName()
+	return &shim{
+		name:  name,
+		cName: v.cName(),
+		src:   fn.CName(),
+		proto: pac.cDecl(fn.ReturnType(), name+"("+join(params, ", ")+")"),
+		body:  cReturn(fn.ReturnType(), fn.CName()+"("+join(args, ", ")+")"),
+	}
+}
+
+// newInlineShim returns the shim of an inline function, which has no symbol
+// to link against.
+func (pac *Package) newInlineShim(fn *gcc.Function) *shim {
+	params, args := pac.cParams(fn.Arguments)
+	if len(params) == 0 {
+		params = []string{"void"}
+	}
+	name := shimPrefix + fn.CName()
+	return &shim{
+		name:  name,
+		cName: fn.CName(),
+		src:   fn.CName(),
+		proto: pac.cDecl(fn.ReturnType(), name+"("+join(params, ", ")+")"),
+		body:  cReturn(fn.ReturnType(), fn.CName()+"("+join(args, ", ")+")"),
+	}
+}
+
+// newMacroShim returns the shim of a function-like macro with its prototype
+// declared like a C function, e.g. "Uint32 SDL_BUTTON(int X)".
+func newMacroShim(name, proto string) (*shim, error) {
+	namePat := regexp.MustCompile(`\b` + regexp.QuoteMeta(name) + `\s*\(`)
+	loc := namePat.FindStringIndex(proto)
+	if loc == nil {
+		return nil, fmt.Errorf("Macros: prototype of %s is %q", name, proto)
+	}
+	paramList := proto[loc[1]:]
+	end := strings.LastIndex(paramList, ")")
+	if end < 0 {
+		return nil, fmt.Errorf("Macros: prototype of %s is %q", name, proto)
+	}
+	paramList = strings.TrimSpace(paramList[:end])
+	var args []string
+	if paramList != "" && paramList != "void" {
+		for _, param := range strings.Split(paramList, ",") {
+			arg := cIdentPat.FindAllString(param, -1)
+			if len(arg) < 2 {
+				return nil, fmt.Errorf("Macros: parameter %q of %s is not named", param, name)
+			}
+			args = append(args, arg[len(arg)-1])
+		}
+	} else {
+		paramList = "void"
+	}
+	shimName := shimPrefix + name
+	expr := name + "(" + join(args, ", ") + ")"
+	body := "return " + expr + ";"
+	if ret := strings.Fields(proto[:loc[0]]); len(ret) == 1 && ret[0] == "void" {
+		body = expr + ";"
+	}
+	return &shim{
+		name:  shimName,
+		cName: name,
+		src:   name,
+		proto: proto[:loc[0]] + shimName + "(" + paramList + ")",
+		body:  body,
+	}, nil
+}
+
+// initializerShims returns the shims returning the values initialized by the
+// initializer macros, e.g. MQTTAsync_connectOptions_initializer.
+func (pac *Package) initializerShims() ([]*shim, error) {
+	pattern := pac.InitializerPattern
+	if pattern == "" {
+		pattern = defaultInitializerPattern
+	}
+	pat, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, Wrapf(err, "InitializerPattern: invalid pattern %q", pattern)
+	}
+	var shims []*shim
+	for _, m := range pac.macros {
+		if m.funcLike || !pac.headerFiles.Has(m.file) || pac.excluded(m.name) {
+			continue
+		}
+		sm := pat.FindStringSubmatch(m.name)
+		if len(sm) < 2 {
+			continue
+		}
+		cType := pac.cTypeName(sm[1])
+		if cType == "" {
+			log.Print("skip initializer macro ", m.name, ": type ", sm[1], " is not found")
+			continue
+		}
+		name := shimPrefix + m.name
+		shims = append(shims, &shim{
+			name:        name,
+			cName:       m.name,
+			src:         m.name,
+			proto:       cType + " " + name + "(void)",
+			body:        cType + " v = " + m.name + ";\n\treturn v;",
+			initializer: true,
+		})
+	}
+	return shims, nil
+}
+
+// cTypeName returns how a struct is referred in C by its name, either a
+// typedef or a struct tag.
+func (pac *Package) cTypeName(name string) string {
+	switch {
+	case pac.xmlInfo.find("Typedef", name) != "":
+		return name
+	case pac.xmlInfo.find("Struct", name) != "":
+		return "struct " + name
+	}
+	return ""
+}
+
+// funcName returns the Go name of a function, New<Type> for the shim of an
+// initializer macro.
+func (pac *Package) funcName(f *Function) string {
+	if f.shim != nil && f.shim.initializer && f.Return != nil {
+		if t := f.Return.type_.GoName(); t != "" && !contains(t, ".") {
+			return pac.uniqueName("New"+t, f.Id())
+		}
+	}
+	return pac.localName(f)
+}
+
+// cParams returns the C parameter declarations of the arguments and their
+// names.
+func (pac *Package) cParams(arguments gcc.Arguments) (params, names []string) {
+	for i, a := range arguments {
+		name := a.CName()
+		if name == "" {
+			name = sprint("a", i)
+		}
+		params = append(params, pac.cDecl(a.CType(), name))
+		names = append(names, name)
+	}
+	return
+}
+
+// cReturn returns the C statement that returns the value of expr.
+func cReturn(ret gcc.Type, expr string) string {
+	if gcc.IsVoid(ret) {
+		return expr + ";"
+	}
+	return "return " + expr + ";"
+}
+
+// cDecl returns the C declaration of name with type gt, e.g. "const char *s".
+func (pac *Package) cDecl(gt gcc.Type, name string) string {
+	if name != "" && !hasPrefix(name, " ") {
+		name = " " + name
+	}
+	switch t := gt.(type) {
+	case *gcc.FundamentalType:
+		return t.CName() + name
+	case *gcc.Enumeration:
+		return "enum " + t.CName() + name
+	case *gcc.Struct:
+		return "struct " + t.CName() + name
+	case *gcc.Union:
+		return "union " + t.CName() + name
+	case *gcc.Typedef:
+		return t.CName() + name
+	case *gcc.PointerType:
+		if _, ok := t.PointedType().(*gcc.FunctionType); ok {
+			return pac.cDecl(t.PointedType(), "(*"+trimPrefix(name, " ")+")")
+		}
+		return pac.cDecl(t.PointedType(), "*"+trimPrefix(name, " "))
+	case *gcc.ArrayType:
+		return pac.cDecl(t.ElementType(), sprint(trimPrefix(name, " "), "[", t.Len(), "]"))
+	case *gcc.FunctionType:
+		params, _ := pac.cParams(t.Arguments)
+		if len(params) == 0 {
+			params = []string{"void"}
+		}
+		return pac.cDecl(t.ReturnType(), trimPrefix(name, " ")+"("+join(params, ", ")+")")
+	case gcc.Aliased:
+		if pac.xmlInfo.attr(gt.Id(), "const") != "1" {
+			return pac.cDecl(t.Base(), name)
+		}
+		if _, ok := t.Base().(*gcc.PointerType); ok {
+			return pac.cDecl(t.Base(), "const"+name)
+		}
+		return "const " + pac.cDecl(t.Base(), name)
+	}
+	panic(fmt.Errorf("cannot declare %s of C type %v", name, gt))
+}
+
+// report the variadic functions that are not wrapped.
+func (pac *Package) reportVariadic(fn *gcc.Function) {
+	if pac.shimmed(fn.CName()) {
+		return
+	}
+	log.Print("skip variadic function ", fn.CName(),
+		", instantiate it by Package.Variadics to wrap it")
+}
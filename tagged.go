@@ -0,0 +1,238 @@
+// Copyright 2014, Hǎiliàng Wáng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cwrap
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+)
+
+// TaggedUnion declares a union whose active member is selected by a tag, so
+// that a method returning a pointer to the active member as a Go interface
+// value is generated, e.g. for SDL_Event:
+//
+//	TaggedUnion{
+//		Type:    "SDL_Event",
+//		Tag:     "type",
+//		Members: map[string]string{"SDL_KEYDOWN": "key", "SDL_KEYUP": "key"},
+//	}
+type TaggedUnion struct {
+	// C name of the struct holding the tag and the union, or of the union
+	// itself if the tag is a member of the union.
+	Type string
+	// C name of the tag field (or member).
+	Tag string
+	// C name of the union field in the struct, empty if Type is the union.
+	Union string
+	// C names of the union members keyed by the tag values, which are C names
+	// of enum values or macro constants, or integers. Tag values of the same
+	// value must select the same member.
+	Members map[string]string
+	// Go name of the method, "Value" if empty.
+	Method string
+}
+
+// taggedMethod is the method of a tagged union returning its active member.
+type taggedMethod struct {
+	recv  string
+	name  string
+	tag   string
+	doc   string
+	cases []taggedCase
+	union string // field of the union in the struct, empty for the union
+}
+
+type taggedCase struct {
+	values []string
+	typ    string // Go type of the member
+}
+
+// prepareTaggedUnions resolves the TaggedUnions to Go names, must go after
+// all the Go names are settled.
+func (pac *Package) prepareTaggedUnions() error {
+	pac.taggedMethods = nil
+	if len(pac.TaggedUnions) == 0 {
+		return nil
+	}
+	values := pac.tagValues()
+	for i := range pac.TaggedUnions {
+		r := &pac.TaggedUnions[i]
+		m, err := pac.newTaggedMethod(r, values)
+		if err != nil {
+			return fmt.Errorf("TaggedUnion %s: %v", r.Type, err)
+		}
+		pac.taggedMethods = append(pac.taggedMethods, m)
+	}
+	return nil
+}
+
+func (pac *Package) newTaggedMethod(r *TaggedUnion, values map[string]tagValue) (*taggedMethod, error) {
+	var d TypeDecl
+	for _, t := range pac.TypeDeclMap.ToSlice() {
+		if t.CName() == r.Type && !contains(t.GoName(), ".") {
+			d = t
+			break
+		}
+	}
+	if d == nil {
+		return nil, fmt.Errorf("type is not found")
+	}
+	m := &taggedMethod{recv: d.GoName(), name: r.Method}
+	if m.name == "" {
+		m.name = "Value"
+	}
+	var u *Union
+	if s := structOf(d); s != nil {
+		tag := pac.structField(s, r.Tag)
+		uf := pac.structField(s, r.Union)
+		if tag == nil || uf == nil {
+			return nil, fmt.Errorf("field %s or %s is not found", r.Tag, r.Union)
+		}
+		if u = unionOfType(uf.EqualType); u == nil {
+			return nil, fmt.Errorf("field %s is not a union", r.Union)
+		}
+		m.tag = "s." + tag.goName
+		if tag.bits > 0 {
+			m.tag += "()"
+		}
+		m.union = uf.goName
+	} else if u = unionOf(d); u != nil {
+		tag := pac.unionField(u, r.Tag)
+		if tag == nil {
+			return nil, fmt.Errorf("member %s is not found", r.Tag)
+		}
+		m.tag = "s." + tag.goName + "()"
+	} else {
+		return nil, fmt.Errorf("type is neither a struct nor a union")
+	}
+	m.doc = sprint(m.name, " returns a pointer to the member of the union selected by ",
+		trimPrefix(m.tag, "s."), ",\nwhich modifies the union in place, or nil if the tag is unknown.")
+
+	members := make(map[string][]string)
+	for _, tag := range sortedKeys(r.Members) {
+		members[r.Members[tag]] = append(members[r.Members[tag]], tag)
+	}
+	seen := make(map[int]string) // members by tag values
+	for _, f := range u.Fields {
+		name := pac.xmlInfo.attr(f.id, "name")
+		tags, ok := members[name]
+		if !ok {
+			continue
+		}
+		delete(members, name)
+		if f.EqualType == nil || f.EqualType.GoName() == "" {
+			return nil, fmt.Errorf("type of member %s is unknown", name)
+		}
+		c := taggedCase{typ: f.EqualType.GoName()}
+		for _, tag := range tags {
+			v, ok := values[tag]
+			if !ok {
+				i, err := strconv.Atoi(tag)
+				if err != nil {
+					return nil, fmt.Errorf("tag value %s is not found", tag)
+				}
+				v = tagValue{tag, i}
+			}
+			// skip the aliases of the same value
+			if member, ok := seen[v.value]; ok {
+				if member != name {
+					return nil, fmt.Errorf("tag value %s selects both %s and %s", tag, member, name)
+				}
+				continue
+			}
+			seen[v.value] = name
+			c.values = append(c.values, v.goName)
+		}
+		if len(c.values) > 0 {
+			m.cases = append(m.cases, c)
+		}
+	}
+	if len(members) > 0 {
+		var names []string
+		for name := range members {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("members %s are not found", join(names, ", "))
+	}
+	return m, nil
+}
+
+type tagValue struct {
+	goName string
+	value  int
+}
+
+// tagValues returns the Go names and values of the enum values and integer
+// constants by their C names.
+func (pac *Package) tagValues() map[string]tagValue {
+	values := make(map[string]tagValue)
+	pac.TypeDeclMap.Each(func(d TypeDecl) {
+		if e, ok := d.(*Enum); ok {
+			for _, v := range e.Values {
+				if v.valid() {
+					values[v.CName()] = tagValue{v.goName, v.value}
+				}
+			}
+		}
+	})
+	for _, c := range pac.Constants {
+		if i, err := strconv.ParseInt(c.value, 0, 64); err == nil {
+			values[c.CName()] = tagValue{c.goName, int(i)}
+		}
+	}
+	return values
+}
+
+func (pac *Package) structField(s *Struct, cName string) *StructField {
+	for i := range s.Fields {
+		if pac.xmlInfo.attr(s.Fields[i].id, "name") == cName {
+			return &s.Fields[i]
+		}
+	}
+	return nil
+}
+
+func (pac *Package) unionField(u *Union, cName string) *UnionField {
+	for i := range u.Fields {
+		if pac.xmlInfo.attr(u.Fields[i].id, "name") == cName {
+			return &u.Fields[i]
+		}
+	}
+	return nil
+}
+
+// unionOfType returns the union of a field type.
+func unionOfType(t EqualType) *Union {
+	switch r := t.(type) {
+	case *Union:
+		return r
+	case *Typedef:
+		if root, ok := r.Root().(*Union); ok {
+			return root
+		}
+	}
+	return nil
+}
+
+func (m *taggedMethod) write(w io.Writer) {
+	writeComment(w, m.doc)
+	fp(w, "func (s *", m.recv, ") ", m.name, "() interface{} {")
+	fp(w, "switch ", m.tag, " {")
+	ptr := "unsafe.Pointer(s)"
+	if m.union != "" {
+		ptr = "unsafe.Pointer(&s." + m.union + ")"
+	}
+	for _, c := range m.cases {
+		fp(w, "case ", join(c.values, ", "), ":")
+		fp(w, "return (*", c.typ, ")(", ptr, ")")
+	}
+	fp(w, "}")
+	fp(w, "return nil")
+	fp(w, "}")
+	fp(w, "")
+}
@@ -0,0 +1,72 @@
+// Copyright 2014, Hǎiliàng Wáng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cwrap
+
+import (
+	"io"
+)
+
+// unionConstructor is the package level function returning a union holding a
+// member.
+type unionConstructor struct {
+	name  string // New<Union>From<Field>
+	union string // Go name of the union
+	field *UnionField
+}
+
+// prepareUnionConstructors names the constructors of the union members once
+// for each union, after its typedef if any, e.g. NewEventFromKey for
+// typedef union {...} SDL_Event. The names are unique in the package.
+func (pac *Package) prepareUnionConstructors() {
+	pac.unionConstructors = nil
+	ds := pac.TypeDeclMap.ToSlice()
+	names := make(map[*Union]string)
+	var unions []*Union
+	for _, d := range ds {
+		var u *Union
+		_, isTypedef := d.(*Typedef)
+		switch t := d.(type) {
+		case *Union:
+			u = t
+		case *Typedef:
+			u, _ = t.Literal.(*Union)
+		}
+		name := d.GoName()
+		if u == nil || d.Id() == "" || name == "" || contains(name, ".") || pac.excluded(d.CName()) {
+			continue
+		}
+		if _, ok := names[u]; !ok {
+			unions = append(unions, u)
+		} else if !isTypedef {
+			continue
+		}
+		names[u] = name
+	}
+	for _, u := range unions {
+		for i := range u.Fields {
+			f := &u.Fields[i]
+			if f.goName == "" || f.EqualType == nil {
+				continue
+			}
+			pac.unionConstructors = append(pac.unionConstructors, &unionConstructor{
+				name:  pac.uniqueName("New"+names[u]+"From"+f.goName, f.id),
+				union: names[u],
+				field: f,
+			})
+		}
+	}
+}
+
+func (pac *Package) writeUnionConstructors(w io.Writer) {
+	for _, c := range pac.unionConstructors {
+		writeComment(w, sprint(c.name, " returns a ", c.union, " holding the member ", c.field.goName, "."))
+		fp(w, "func ", c.name, "(v ", c.field.EqualType.GoName(), ") ", c.union, " {")
+		fp(w, "var u ", c.union)
+		fp(w, "u.Set", c.field.goName, "(v)")
+		fp(w, "return u")
+		fp(w, "}")
+		fp(w)
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright 2014, Hǎiliàng Wáng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cwrap
+
+import (
+	"strings"
+	"testing"
+)
+
+func newUnion(id, cName, goName string, fields ...string) *Union {
+	u := &Union{baseCNamer: baseCNamer{id: id, cName: cName},
+		baseEqualType: baseEqualType{goName: goName, size: 4}}
+	for _, f := range fields {
+		u.Fields = append(u.Fields, UnionField{goName: f, EqualType: NewNum("int32", "C.int", 4),
+			union: u, id: id + "." + f})
+	}
+	return u
+}
+
+func newTypedef(id, cName, goName string, literal SpecWriter) *Typedef {
+	return &Typedef{baseCNamer: baseCNamer{id: id, cName: cName},
+		baseEqualType: baseEqualType{goName: goName}, Literal: literal}
+}
+
+func TestUnionConstructors(t *testing.T) {
+	// typedef union tag {int i;} name;
+	tagged := newUnion("u1", "tag", "Tag", "I")
+	// typedef union {int x;} anon;
+	anon := newUnion("u2", "", "", "X")
+	pac := &Package{localNames: map[string]string{"NewNameFromI": "f1"}}
+	pac.TypeDeclMap = TypeDeclMap{
+		"u1": tagged,
+		"t1": newTypedef("t1", "name", "Name", tagged),
+		"u2": anon,
+		"t2": newTypedef("t2", "anon", "Anon", anon),
+	}
+	pac.prepareUnionConstructors()
+	var names []string
+	for _, c := range pac.unionConstructors {
+		names = append(names, c.name+":"+c.union)
+	}
+	// NewNameFromI is taken by a function
+	if got, expect := join(names, " "), "NewAnonFromX:Anon NewNameFromI_:Name"; got != expect {
+		t.Errorf("expect constructors %q, got %q", expect, got)
+	}
+	code := writeToString(pac.writeUnionConstructors)
+	for _, expect := range []string{
+		"// NewAnonFromX returns a Anon holding the member X.",
+		"func NewAnonFromX(v int32) Anon {",
+		"u.SetX(v)",
+	} {
+		if !strings.Contains(code, expect) {
+			t.Errorf("expect %q in\n%s", expect, code)
+		}
+	}
+}
+
+func TestUnionFieldNames(t *testing.T) {
+	u := newUnion("u1", "tag", "Tag", "I", "J", "K", "L")
+	methods := Methods{
+		{Function: &Function{goName: "I"}},
+		{Function: &Function{goName: "SetJ"}},
+		{Function: &Function{goName: "AsK"}},
+	}
+	u.OptimizeFieldNames(methods)
+	var names []string
+	for _, f := range u.Fields {
+		names = append(names, f.goName)
+	}
+	if got, expect := join(names, " "), "I_ J_ K_ L"; got != expect {
+		t.Errorf("expect fields %q, got %q", expect, got)
+	}
+}
@@ -174,6 +174,12 @@ func (r *ReturnPtr) ToCgo(w io.Writer, assign, g, c string) {
 	convPtr(w, assign, "&"+g, c, r.CgoName())
 }
 
+// InOutPtr is a pointer argument that C both reads and writes, so the pointed
+// value is passed in by Go and returned as a result as well.
+type InOutPtr struct {
+	ReturnPtr
+}
+
 type Ptr struct {
 	pointedType EqualType
 }
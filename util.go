@@ -12,6 +12,7 @@ import (
 	"os/exec"
 	"reflect"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"unsafe"
@@ -89,6 +90,10 @@ func hasPrefix(s, prefix string) bool {
 	return strings.HasPrefix(s, prefix)
 }
 
+func hasSuffix(s, suffix string) bool {
+	return strings.HasSuffix(s, suffix)
+}
+
 func snakeToLowerCamel(s string) string {
 	if len(s) <= 1 {
 		return s
@@ -101,14 +106,6 @@ func spaceToSnake(s string) string {
 	return strings.Replace(s, " ", "_", -1)
 }
 
-func typeSizeAssert(ctype, gotype string) string {
-	return fmt.Sprintf(
-		`	if s1, s2 := unsafe.Sizeof(%[1]s), unsafe.Sizeof(%[2]s); s1 != s2 {
-			panic(fmt.Errorf("Size of %[1]s is %%d, expected %%d as Go's %[2]s.", s1, s2))
-		}
-	`, ctype, gotype)
-}
-
 type SSet struct {
 	m map[string]struct{}
 }
@@ -147,6 +144,24 @@ func contains(s, substr string) bool {
 	return strings.Contains(s, substr)
 }
 
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func containsString(ss []string, s string) bool {
+	for _, e := range ss {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
 func replace(s, old, new string) string {
 	return strings.Replace(s, old, new, -1)
 }
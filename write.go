@@ -12,40 +12,65 @@ func (pac *Package) prepareFunctions() error {
 	// write .h/.c directly
 	var functions []*Function
 	var callbacks []CallbackFunc
-	callbackSet := NewSSet()
+	pac.pools = nil
+	pac.retains = nil
 	for _, fn := range pac.XmlDoc.Functions {
-		if len(fn.Ellipses) > 0 {
+		cName := fn.CName()
+		if s := pac.shimOf(cName); s != nil {
+			cName = s.cName
+		} else if pac.replaced(cName) {
 			continue
 		}
-		if !pac.exported(fn.CName(), fn.File()) {
+		if !pac.exported(cName, fn.File()) {
 			// log.Print("skip unexported function ", fn.CName(), " in ", fn.File())
 			continue
 		}
+		if len(fn.Ellipses) > 0 {
+			pac.reportVariadic(fn)
+			continue
+		}
 		f := pac.newFunction(fn)
-		if info, ok := fn.HasCallback(); ok {
+		if ps := pac.callbackParams(fn); len(ps) > 1 {
+			f1, cbs := pac.transformCallbacks(fn, ps)
+			for _, cb := range cbs {
+				callbacks = addCallback(callbacks, cb)
+			}
+			f2 := pac.newFunction(fn)
+			f2.id += "_original"
+			functions = append(functions, f1, f2)
+		} else if ps := pac.poolParams(fn); len(ps) > 0 {
+			f1, cbs := pac.transformPoolCallbacks(fn, ps)
+			callbacks = append(callbacks, cbs...)
+			f2 := pac.newFunction(fn)
+			f2.id += "_original"
+			functions = append(functions, f1, f2)
+		} else if info, ok := fn.HasCallback(); ok {
 			// Go file
+			// shared by the functions taking the same callback type
 			callbackFunc := pac.newCallbackFunc(info)
-
-			if !callbackSet.Has(callbackFunc.goName) {
-				callbacks = append(callbacks, callbackFunc)
-			}
+			callbackFunc.name = info.CName
+			callbackFunc.uses = []string{cName + "." + fn.Arguments[info.ArgIndex].CName()}
+			callbacks = addCallback(callbacks, callbackFunc)
 
 			f1, f2 := pac.TransformOriginalFunc(fn, callbackFunc, info)
 			functions = append(functions, f1)
 			functions = append(functions, f2)
-
-			if !callbackSet.Has(callbackFunc.goName) {
-
-			}
-
-			// add into set
-			callbackSet.Add(callbackFunc.goName)
 		} else {
 			functions = append(functions, f)
 		}
 	}
+	if err := pac.prepareRetained(functions); err != nil {
+		return err
+	}
+	if err := pac.prepareBuffers(functions); err != nil {
+		return err
+	}
 	pac.Functions = functions
-	pac.Callbacks = callbacks
+	pac.Callbacks = append(callbacks, pac.fieldCallbacks()...)
+	if err := pac.preparePanicReturns(); err != nil {
+		return err
+	}
+	pac.prepareErrorType()
 
 	// populate variables (and collect types)
 	variables := make([]*Variable, 0, len(pac.Variables))
@@ -93,8 +118,14 @@ func (pac *Package) prepareTypesAndNames() {
 		}
 	})
 
+	// anonymous types are named after their parents.
+	anon := pac.anonymousTypes()
+
 	// assign names to types, if empty, remove it.
 	pac.TypeDeclMap.Each(func(d TypeDecl) {
+		if _, ok := anon[d.Id()]; ok {
+			return
+		}
 		goName := pac.globalName(d)
 		if goName != "" {
 			d.SetGoName(goName)
@@ -102,6 +133,7 @@ func (pac *Package) prepareTypesAndNames() {
 			excluded = append(excluded, d.Id())
 		}
 	})
+	excluded = append(excluded, pac.nameAnonymous(anon)...)
 
 	// assign names to functions (must go after types because type name of
 	// receiver must be settled first.
@@ -111,7 +143,7 @@ func (pac *Package) prepareTypesAndNames() {
 			if m, ok := f.ConvertToMethod(); ok {
 				m.SetGoName(pac.UpperName(f.CName()))
 			} else {
-				f.SetGoName(pac.localName(f))
+				f.SetGoName(pac.funcName(f))
 				fs = append(fs, f)
 			}
 		}
@@ -149,6 +181,9 @@ func (pac *Package) prepareTypesAndNames() {
 		}
 	})
 
+	// name the constructors of union members, which are package level.
+	pac.prepareUnionConstructors()
+
 	// assign name to variables
 	for _, v := range pac.Variables {
 		v.SetGoName(pac.localName(v))
@@ -158,11 +193,13 @@ func (pac *Package) prepareTypesAndNames() {
 	for _, id := range excluded {
 		pac.TypeDeclMap.Delete(id)
 	}
+
+	pac.prepareDocs()
 }
 
 // Huge function to write all the stuff
 func (pac *Package) write() error {
-	if len(pac.Callbacks) > 0 {
+	if pac.hasCFile() {
 		c, err := pac.createFile(pac.cFile())
 		if err != nil {
 			return err
@@ -191,19 +228,51 @@ func (pac *Package) write() error {
 	if err := gofmt(pac.goFile()); err != nil {
 		return err
 	}
-
 	log.Print("written to ", pac.goFile())
+
+	if len(pac.layoutDecls()) > 0 {
+		t, err := pac.createFile(pac.testFile())
+		if err != nil {
+			return err
+		}
+		defer t.Close()
+		pac.writeLayoutTest(t)
+		if err := gofmt(pac.testFile()); err != nil {
+			return err
+		}
+		log.Print("written to ", pac.testFile())
+	}
+
 	pac.Statistics.Print()
 	p()
 
 	return nil
 }
 
+// the C file is needed for callbacks and shims.
+func (pac *Package) hasCFile() bool {
+	return len(pac.Callbacks) > 0 || len(pac.shims) > 0 || len(pac.pools) > 0
+}
+
 func (pac *Package) writeCFile(c, h io.Writer) error {
 	// C file starts
 	fp(c, `#include "_cgo_export.h"`)
+	if len(pac.shims) > 0 {
+		pac.From.Write(c)
+		fp(c, `#include "`, path.Base(pac.hFile()), `"`)
+	}
 	fp(c, "")
 
+	for _, s := range pac.shims {
+		// H file
+		s.writeDecl(h)
+		fp(h, "")
+
+		// C file
+		s.writeDef(c)
+		fp(c, "")
+	}
+
 	for _, callbackFunc := range pac.Callbacks {
 		// H file
 		fpn(h, "extern ")
@@ -215,6 +284,13 @@ func (pac *Package) writeCFile(c, h io.Writer) error {
 		callbackFunc.CType.WriteCallbackStub(c, callbackFunc.cFuncName, callbackFunc.goName)
 		fp(c, "")
 	}
+
+	for _, p := range pac.pools {
+		p.writeDecl(h, pac)
+		fp(h, "")
+		p.writeDef(c, pac)
+		fp(c, "")
+	}
 	return nil
 }
 
@@ -224,10 +300,11 @@ func (pac *Package) writeGoFile(g io.Writer) error {
 	fp(g, "")
 	fp(g, "/*")
 	fp(g, "#include <", pac.From.File, ">")
-	if len(pac.Callbacks) > 0 {
+	if pac.hasCFile() {
 		fp(g, `#include "`, path.Base(pac.hFile()), `"`)
 	}
 	fp(g, "#include <stdlib.h>")
+	pac.writeCHandle(g)
 	for _, d := range pac.From.CgoDirectives {
 		fp(g, "#cgo ", d)
 	}
@@ -235,13 +312,16 @@ func (pac *Package) writeGoFile(g io.Writer) error {
 	fp(g, `import "C"`)
 	fp(g, "")
 	fp(g, "import (")
-	fp(g, `"unsafe"`)
-	for _, inc := range pac.Included {
-		fp(g, `"`, inc.PacPath, `"`)
+	for _, imp := range pac.goImports() {
+		fp(g, `"`, imp, `"`)
 	}
 	fp(g, ")")
 	fp(g, "")
 
+	for _, c := range pac.Constants {
+		pac.writeDecl(g, "const", c)
+	}
+
 	for _, v := range pac.Variables {
 		pac.writeDecl(g, "var", v)
 	}
@@ -252,10 +332,32 @@ func (pac *Package) writeGoFile(g io.Writer) error {
 		fp(g, "")
 	}
 
+	for _, m := range pac.taggedMethods {
+		m.write(g)
+	}
+
+	pac.writeUnionConstructors(g)
+
+	pac.writeOwners(g)
+
+	pac.writePanicHandler(g)
+	pac.writeHandles(g)
+	pac.writeRetained(g)
+	pac.writeFuncStructs(g)
+	pac.writePools(g)
+
+	pac.writeErrorType(g)
+
 	for _, f := range pac.Functions {
 		pac.writeDecl(g, "func", f)
 	}
 
+	pac.eachFunction(func(f *Function) {
+		if f.holder != nil {
+			f.holder.write(g)
+		}
+	})
+
 	for _, f := range pac.Callbacks {
 		f.Declare(g)
 	}
@@ -263,13 +365,70 @@ func (pac *Package) writeGoFile(g io.Writer) error {
 	return nil
 }
 
+// packages imported by the Go file
+func (pac *Package) goImports() []string {
+	imports := []string{"unsafe"}
+	add := func(imp string) {
+		if !containsString(imports, imp) {
+			imports = append(imports, imp)
+		}
+	}
+	if pac.ErrorRule != nil && pac.ErrorRule.Message == "" {
+		add("strconv")
+	}
+	hasPrintf := false
+	pac.eachFunction(func(f *Function) {
+		if f.shim != nil && f.shim.printf {
+			hasPrintf = true
+		}
+	})
+	if hasPrintf {
+		add("fmt")
+	}
+	if pac.hasFinalizers() {
+		add("runtime")
+	}
+	if len(pac.Callbacks) > 0 {
+		add("log")
+		add("runtime/debug")
+	}
+	if pac.usesHandles() {
+		add("sync")
+	}
+	if len(pac.pools) > 0 {
+		add("strconv")
+		add("sync")
+	}
+	if pac.hasCallbackHandle() || len(pac.retains) > 0 {
+		add("sync")
+	}
+	for _, inc := range pac.Included {
+		imports = append(imports, inc.PacPath)
+	}
+	return imports
+}
+
+// eachFunction visits the functions and the methods to write.
+func (pac *Package) eachFunction(visit func(f *Function)) {
+	for _, f := range pac.Functions {
+		visit(f)
+	}
+	pac.TypeDeclMap.Each(func(d TypeDecl) {
+		if ms := methodsOf(d); ms != nil {
+			for _, m := range *ms {
+				visit(m.Function)
+			}
+		}
+	})
+}
+
 func (pac *Package) writeDecl(w io.Writer, keyword string, d Decl) {
 	if pac.excluded(d.CName()) || contains(d.GoName(), ".") {
 		return
 	}
 	if d.GoName() != "" &&
 		d.Id() != "" { // is not simple typedef
-		fp(w, "// ", d.CName())
+		writeDoc(w, d.Doc(), d.CName())
 		fpn(w, keyword, " ", d.GoName(), " ")
 		d.WriteSpec(w)
 	}
@@ -295,9 +454,13 @@ func (pac *Package) globalName(o CNamer) string {
 
 // upper name that is unique within the package
 func (pac *Package) localName(o CNamer) string {
-	n := pac.UpperName(o.CName())
-	if sid, exists := pac.localNames[n]; !exists || o.Id() == sid {
-		pac.localNames[n] = o.Id()
+	return pac.uniqueName(pac.UpperName(o.CName()), o.Id())
+}
+
+// name that is unique within the package
+func (pac *Package) uniqueName(n, id string) string {
+	if sid, exists := pac.localNames[n]; !exists || id == sid {
+		pac.localNames[n] = id
 		return n
 	}
 	for {
@@ -306,7 +469,7 @@ func (pac *Package) localName(o CNamer) string {
 			break
 		}
 	}
-	pac.localNames[n] = o.Id()
+	pac.localNames[n] = id
 	return n
 }
 
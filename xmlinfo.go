@@ -0,0 +1,110 @@
+// Copyright 2014, Hǎiliàng Wáng. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cwrap
+
+import (
+	"encoding/xml"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+)
+
+// xmlInfo keeps the raw attributes of the elements in the castxml output, so
+// that the attributes not exposed by go-gccxml (line numbers, field offsets,
+// etc.) can be looked up by element id.
+type xmlInfo struct {
+	nodes map[string]*xmlNode
+}
+
+type xmlNode struct {
+	kind  string
+	attrs map[string]string
+}
+
+func loadXmlInfo(file string) (*xmlInfo, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, Wrap(err)
+	}
+	defer f.Close()
+	info := &xmlInfo{nodes: make(map[string]*xmlNode)}
+	d := xml.NewDecoder(f)
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, Wrapf(err, "fail to parse %s", file)
+		}
+		if e, ok := tok.(xml.StartElement); ok {
+			n := &xmlNode{kind: e.Name.Local, attrs: make(map[string]string)}
+			for _, a := range e.Attr {
+				n.attrs[a.Name.Local] = a.Value
+			}
+			if id := n.attrs["id"]; id != "" {
+				info.nodes[id] = n
+			}
+		}
+	}
+	return info, nil
+}
+
+func (info *xmlInfo) node(id string) *xmlNode {
+	if info == nil {
+		return nil
+	}
+	return info.nodes[id]
+}
+
+// find returns the id of the element of the kind and name.
+func (info *xmlInfo) find(kind, name string) string {
+	if info == nil {
+		return ""
+	}
+	for id, n := range info.nodes {
+		if n.kind == kind && n.attrs["name"] == name {
+			return id
+		}
+	}
+	return ""
+}
+
+func (info *xmlInfo) attr(id, name string) string {
+	if n := info.node(id); n != nil {
+		return n.attrs[name]
+	}
+	return ""
+}
+
+// intAttr returns the integer value of an attribute, or -1 if it is absent.
+func (info *xmlInfo) intAttr(id, name string) int {
+	i, err := strconv.Atoi(info.attr(id, name))
+	if err != nil {
+		return -1
+	}
+	return i
+}
+
+// ids returns the ids of the elements of the kind in the order of the castxml
+// output.
+func (info *xmlInfo) ids(kind string) []string {
+	if info == nil {
+		return nil
+	}
+	var ids []string
+	for id, n := range info.nodes {
+		if n.kind == kind {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if len(ids[i]) != len(ids[j]) {
+			return len(ids[i]) < len(ids[j])
+		}
+		return ids[i] < ids[j]
+	})
+	return ids
+}